@@ -0,0 +1,43 @@
+#!/bin/sh
+# Stands in for gphoto2 when developing without a tethered camera. Previews
+# and stills are copies of $GPHOTO2_STUB_IMAGE.
+
+set -e
+
+image="${GPHOTO2_STUB_IMAGE:?GPHOTO2_STUB_IMAGE must be set}"
+filename=""
+action=""
+
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--auto-detect|--capture-preview|--capture-image-and-download)
+		action="$1"
+		;;
+	--filename)
+		shift
+		filename="$1"
+		;;
+	esac
+	shift
+done
+
+case "$action" in
+--auto-detect)
+	echo "Model                          Port"
+	echo "----------------------------------------------------------"
+	echo "Stub Camera                    usb:001,001"
+	;;
+--capture-preview)
+	cat "$image"
+	;;
+--capture-image-and-download)
+	ext="${image##*.}"
+	out=$(echo "$filename" | sed "s/%C/$ext/")
+	cp "$image" "$out"
+	echo "Saving file as $out"
+	;;
+*)
+	echo "gphoto2-stub: unsupported arguments" >&2
+	exit 1
+	;;
+esac
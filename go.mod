@@ -8,6 +8,7 @@ require (
 	gocv.io/x/gocv v0.35.0
 	golang.org/x/oauth2 v0.17.0
 	google.golang.org/api v0.165.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
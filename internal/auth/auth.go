@@ -4,28 +4,28 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
-	"os"
 	"time"
 
+	"github.com/dstuessy/film-scanner/internal/config"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
 const AccessTokenCookieName = "access_token"
 
-var OauthConf *oauth2.Config
-
 type TokenExpiredError struct{}
 
 func (m *TokenExpiredError) Error() string {
 	return "Token Expired"
 }
 
-func Setup() {
-	OauthConf = &oauth2.Config{
-		ClientID:     os.Getenv("OAUTH_CLIENT_ID"),
-		ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("OAUTH_REDIRECT_URL"),
+// NewOauthConfig configures Google sign in with access to the files the app
+// creates in Drive.
+func NewOauthConfig(conf config.AuthConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		RedirectURL:  conf.RedirectURL,
 		Scopes: []string{
 			"https://www.googleapis.com/auth/userinfo.email",
 			"https://www.googleapis.com/auth/userinfo.profile",
@@ -1,34 +1,47 @@
 package cache
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/dstuessy/film-scanner/internal/config"
 )
 
-var cacheDir string
 var dirPerm os.FileMode = 0755
 var filePerm os.FileMode = 0644
 
-func SetupCacheDir() error {
-	cacheDir = os.Getenv("CACHE_DIR")
+// metaDir holds the JSON metadata of cached images within a project dir.
+const metaDir = ".meta"
+
+// Cache holds the scans of each project in a directory of their own until
+// they are uploaded.
+type Cache struct {
+	dir string
+}
 
-	if _, err := os.Stat(cacheDir); err != nil {
-		err := os.Mkdir(cacheDir, dirPerm)
+// NewCache creates the configured cache directory if it does not exist.
+func NewCache(conf config.CacheConfig) (*Cache, error) {
+	if _, err := os.Stat(conf.Dir); err != nil {
+		err := os.Mkdir(conf.Dir, dirPerm)
 		if err != nil {
-			log.Println("Failed to create cache dir:", cacheDir)
-			return err
+			log.Println("Failed to create cache dir:", conf.Dir)
+			return nil, err
 		}
-		log.Println("Created cache dir:", cacheDir)
+		log.Println("Created cache dir:", conf.Dir)
 	}
 
-	return nil
+	return &Cache{dir: conf.Dir}, nil
 }
 
-func ReadProject(projectId string) ([]string, error) {
-	projectDir := filepath.Join(cacheDir, projectId)
+func (c *Cache) ReadProject(projectId string) ([]string, error) {
+	projectDir := filepath.Join(c.dir, projectId)
 
 	files, err := os.ReadDir(projectDir)
 	if err != nil {
@@ -37,14 +50,18 @@ func ReadProject(projectId string) ([]string, error) {
 
 	fileNames := make([]string, 0)
 	for _, f := range files {
+		// hidden files are images still being written
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
 		fileNames = append(fileNames, f.Name())
 	}
 
 	return fileNames, nil
 }
 
-func ReadImage(projectId, fileName string) ([]byte, error) {
-	filePath := filepath.Join(cacheDir, projectId, fileName)
+func (c *Cache) ReadImage(projectId, fileName string) ([]byte, error) {
+	filePath := filepath.Join(c.dir, projectId, fileName)
 
 	file, err := os.ReadFile(filePath)
 	if err != nil {
@@ -54,14 +71,36 @@ func ReadImage(projectId, fileName string) ([]byte, error) {
 	return file, nil
 }
 
-func CacheImage(img []byte, name, projectId string) error {
-	projectDir := filepath.Join(cacheDir, projectId)
+// OpenImage opens a cached image for reading, for callers that stream it
+// rather than read it whole.
+func (c *Cache) OpenImage(projectId, fileName string) (*os.File, error) {
+	filePath := filepath.Join(c.dir, projectId, fileName)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open image %s", filePath))
+	}
+
+	return file, nil
+}
+
+func (c *Cache) makeProjectDir(projectId string) (string, error) {
+	projectDir := filepath.Join(c.dir, projectId)
 	if _, err := os.Stat(projectDir); err != nil {
 		if err := os.Mkdir(projectDir, dirPerm); err != nil {
-			return errors.New(fmt.Sprintf("Failed to create project directory %s", projectDir))
+			return "", errors.New(fmt.Sprintf("Failed to create project directory %s", projectDir))
 		}
 	}
 
+	return projectDir, nil
+}
+
+func (c *Cache) CacheImage(img []byte, name, projectId string) error {
+	projectDir, err := c.makeProjectDir(projectId)
+	if err != nil {
+		return err
+	}
+
 	filePath := filepath.Join(projectDir, name)
 	if os.WriteFile(filePath, img, filePerm) != nil {
 		return errors.New(fmt.Sprintf("Failed to write image to cache %s", filePath))
@@ -70,17 +109,99 @@ func CacheImage(img []byte, name, projectId string) error {
 	return nil
 }
 
-func DeleteImage(projectId, fileName string) error {
-	filePath := filepath.Join(cacheDir, projectId, fileName)
+// StreamImage caches an image as write encodes it, without holding it in
+// memory. It is written to a hidden file that is renamed once complete, so a
+// failed write leaves nothing behind.
+func (c *Cache) StreamImage(name, projectId string, write func(io.Writer) error) error {
+	projectDir, err := c.makeProjectDir(projectId)
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(projectDir, name)
+	partPath := filepath.Join(projectDir, fmt.Sprintf(".%s.part", name))
+
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to create image in cache %s", partPath))
+	}
+
+	w := bufio.NewWriter(file)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return errors.New(fmt.Sprintf("Failed to write image to cache %s: %s", filePath, err))
+	}
+
+	if os.Rename(partPath, filePath) != nil {
+		os.Remove(partPath)
+		return errors.New(fmt.Sprintf("Failed to write image to cache %s", filePath))
+	}
+
+	return nil
+}
+
+func (c *Cache) DeleteImage(projectId, fileName string) error {
+	filePath := filepath.Join(c.dir, projectId, fileName)
 	if os.Remove(filePath) != nil {
 		return errors.New(fmt.Sprintf("Failed to delete image from cache %s", filePath))
 	}
 
+	metaPath := filepath.Join(c.dir, projectId, metaDir, fmt.Sprintf("%s.json", fileName))
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New(fmt.Sprintf("Failed to delete image metadata from cache %s", metaPath))
+	}
+
 	return nil
 }
 
-func ClearCache(projectId string) error {
-	projectDir := filepath.Join(cacheDir, projectId)
+func (c *Cache) CacheMeta(meta interface{}, name, projectId string) error {
+	dir := filepath.Join(c.dir, projectId, metaDir)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return errors.New(fmt.Sprintf("Failed to create metadata directory %s", dir))
+	}
+
+	file, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(dir, fmt.Sprintf("%s.json", name))
+	if os.WriteFile(filePath, file, filePerm) != nil {
+		return errors.New(fmt.Sprintf("Failed to write metadata to cache %s", filePath))
+	}
+
+	return nil
+}
+
+// ReadMeta decodes the metadata of a cached image into meta. It returns
+// false if no metadata was cached for the image.
+func (c *Cache) ReadMeta(projectId, fileName string, meta interface{}) (bool, error) {
+	filePath := filepath.Join(c.dir, projectId, metaDir, fmt.Sprintf("%s.json", fileName))
+
+	file, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Failed to read metadata %s", filePath))
+	}
+
+	if err := json.Unmarshal(file, meta); err != nil {
+		return false, errors.New(fmt.Sprintf("Failed to parse metadata %s", filePath))
+	}
+
+	return true, nil
+}
+
+func (c *Cache) ClearCache(projectId string) error {
+	projectDir := filepath.Join(c.dir, projectId)
 	if _, err := os.Stat(projectDir); err != nil {
 		return errors.New(fmt.Sprintf("Project directory %s not found", projectDir))
 	}
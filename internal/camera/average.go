@@ -0,0 +1,71 @@
+package camera
+
+import (
+	"errors"
+	"sort"
+)
+
+// AverageStills averages identical 8 or 16-bit exposures to reduce sensor
+// noise. With three or more stills the brightest and darkest sample of every
+// pixel are dropped first, so dust, hot pixels or a flickering backlight in
+// a single shot do not bleed into the result. The average is returned with
+// 16-bit samples to keep the precision gained.
+func AverageStills(stills []ImageData) (ImageData, error) {
+	if len(stills) == 0 {
+		return ImageData{}, errors.New("No stills to average")
+	}
+
+	for _, s := range stills {
+		if s.Rows != stills[0].Rows || s.Cols != stills[0].Cols || len(s.Data) != len(stills[0].Data) {
+			return ImageData{}, errors.New("Stills to average differ in size")
+		}
+		if s.BitDepth() != stills[0].BitDepth() {
+			return ImageData{}, errors.New("Stills to average differ in bit depth")
+		}
+	}
+
+	trim := 0
+	if len(stills) >= 3 {
+		trim = 1
+	}
+	kept := len(stills) - 2*trim
+
+	wide := stills[0].BitDepth() == 16
+	n := len(stills[0].Data)
+	if wide {
+		n /= 2
+	}
+
+	out := ImageData{
+		Rows:     stills[0].Rows,
+		Cols:     stills[0].Cols,
+		Data:     make([]byte, n*2),
+		Depth:    16,
+		Channels: stills[0].Channels,
+	}
+
+	samples := make([]int, len(stills))
+	for i := 0; i < n; i++ {
+		for j, s := range stills {
+			if wide {
+				samples[j] = int(s.Data[2*i]) | int(s.Data[2*i+1])<<8
+			} else {
+				// scale 0..255 to 0..65535
+				samples[j] = int(s.Data[i]) * 257
+			}
+		}
+		if trim > 0 {
+			sort.Ints(samples)
+		}
+
+		sum := 0
+		for _, v := range samples[trim : len(samples)-trim] {
+			sum += v
+		}
+		v := (sum + kept/2) / kept
+		out.Data[2*i] = byte(v)
+		out.Data[2*i+1] = byte(v >> 8)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package camera
+
+import (
+	"errors"
+
+	"gocv.io/x/gocv"
+)
+
+// MergeBrackets aligns a set of differently exposed stills of the same frame
+// and blends them with Mertens exposure fusion, which needs no exposure
+// times or tone mapping.
+func MergeBrackets(stills []ImageData) (ImageData, error) {
+	if len(stills) < 2 {
+		return ImageData{}, errors.New("At least two brackets are needed to merge")
+	}
+
+	src := make([]gocv.Mat, 0, len(stills))
+	defer func() {
+		for _, m := range src {
+			m.Close()
+		}
+	}()
+
+	for _, s := range stills {
+		if s.Rows != stills[0].Rows || s.Cols != stills[0].Cols {
+			return ImageData{}, errors.New("Brackets differ in size")
+		}
+
+		// alignment and fusion work on 8-bit images
+		mat, err := MatFromData(Data8Bit(s))
+		if err != nil {
+			return ImageData{}, err
+		}
+		src = append(src, mat)
+	}
+
+	// median threshold bitmaps are insensitive to exposure, so the shifts
+	// between brackets are found even though their brightness differs
+	aligned := make([]gocv.Mat, 0, len(src))
+	defer func() {
+		for _, m := range aligned {
+			m.Close()
+		}
+	}()
+
+	align := gocv.NewAlignMTB()
+	defer align.Close()
+	align.Process(src, &aligned)
+
+	fused := gocv.NewMat()
+	defer fused.Close()
+
+	merge := gocv.NewMergeMertens()
+	defer merge.Close()
+	merge.Process(aligned, &fused)
+
+	if fused.Empty() {
+		return ImageData{}, errors.New("Exposure fusion produced no image")
+	}
+
+	// fusion yields floats around 0..1
+	merged := gocv.NewMat()
+	defer merged.Close()
+	fused.ConvertToWithParams(&merged, gocv.MatTypeCV8UC3, 255, 0)
+
+	return DataFromMat(merged), nil
+}
@@ -3,112 +3,124 @@ package camera
 import (
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
-	"strconv"
+	"mime"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"gocv.io/x/gocv"
+	"github.com/dstuessy/film-scanner/internal/config"
 )
 
-var webcam *gocv.VideoCapture
-
 var FrameInterval = 60 * time.Millisecond
 
+// ImageData holds pixels row by row, RGB for colour images. Depth is the
+// bits per sample, 8 or 16 with 16-bit samples stored little-endian, and
+// Channels is 3 for RGB or 1 for greyscale. Zero values mean 8-bit RGB.
 type ImageData struct {
-	Rows int
-	Cols int
-	Data []byte
+	Rows     int
+	Cols     int
+	Data     []byte
+	Depth    int
+	Channels int
 }
 
-func IsCameraOpen() bool {
-	if webcam == nil {
-		return false
+func (img ImageData) BitDepth() int {
+	if img.Depth == 0 {
+		return 8
 	}
-
-	return webcam.IsOpened()
+	return img.Depth
 }
 
-func OpenCamera() error {
-	if webcam != nil {
-		return nil
-	}
-
-	c, err := gocv.OpenVideoCapture(0)
-	if err != nil {
-		return err
+func (img ImageData) NumChannels() int {
+	if img.Channels == 0 {
+		return 3
 	}
+	return img.Channels
+}
 
-	if os.Getenv("CAM_WIDTH") != "" && os.Getenv("CAM_HEIGHT") != "" {
-		w, err := strconv.ParseFloat(os.Getenv("CAM_WIDTH"), 64)
-		if err != nil {
-			return err
-		}
-		c.Set(gocv.VideoCaptureFrameWidth, w)
-
-		h, err := strconv.ParseFloat(os.Getenv("CAM_HEIGHT"), 64)
-		if err != nil {
-			return err
-		}
-		c.Set(gocv.VideoCaptureFrameHeight, h)
-	}
+// PixelSize is the number of bytes per pixel.
+func (img ImageData) PixelSize() int {
+	return img.NumChannels() * img.BitDepth() / 8
+}
 
-	webcam = c
+// Capabilities describes what a capture backend is able to do.
+type Capabilities struct {
+	Name    string
+	Preview bool
+	Still   bool
+	Width   int
+	Height  int
+}
 
-	return nil
+// Still is a captured image file, with the extension of its format, e.g.
+// ".jpg", as a camera may return another format than configured.
+type Still struct {
+	Data []byte
+	Ext  string
+	// Original is the RAW of a RAW+JPEG capture, returned along with the
+	// JPEG as only the JPEG can be processed
+	Original *Still
 }
 
-func CloseCamera() error {
-	if err := webcam.Close(); err != nil {
-		webcam = nil
-		return err
-	}
-	webcam = nil
-	return nil
+// Camera is a capture backend providing preview frames for the stream and
+// full resolution stills for scans.
+type Camera interface {
+	Open() error
+	Close() error
+	IsOpen() bool
+	ReadFrame() (ImageData, error)
+	CaptureStill(params StillParams) (Still, error)
+	Capabilities() Capabilities
 }
 
-func CaptureStill() ([]byte, error) {
-	if webcam != nil {
-		return nil, errors.New("Camera is still open for streaming")
+// NewCamera returns the configured capture backend. The "video" backend
+// uses the webcam and the still command, "gphoto2" drives a tethered camera,
+// while "file" serves the configured image, or a synthetic test pattern if
+// none is set.
+func NewCamera(conf config.CameraConfig) (Camera, error) {
+	switch conf.Backend {
+	case "", "video", "gphoto2":
+	case "file":
+		return NewFileCamera(conf), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown camera backend %s", conf.Backend))
 	}
 
-	if os.Getenv("STILL_IMG_COMMAND") == "" {
-		return nil, errors.New("STILL_IMG_COMMAND not set")
+	dir, err := makeTempDir(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	imgName := fmt.Sprintf(os.Getenv("STILL_IMG_NAME"), time.Now().Unix())
-	imgLoc := fmt.Sprintf("%s/%s", tmpdir, imgName)
-
-	// imgCmd := fmt.Sprintf(os.Getenv("STILL_IMG_COMMAND"), imgLoc)
-	imgCmds := strings.ReplaceAll(os.Getenv("STILL_IMG_COMMAND"), "{image}", imgLoc)
-	for _, imgCmd := range strings.Split(imgCmds, ";") {
-		slicedCmd := strings.Split(strings.Trim(imgCmd, " "), " ")
-
-		log.Println("Capturing still image with command:", imgCmd)
-
-		cmd := exec.Command(slicedCmd[0], slicedCmd[1:]...)
-
-		output, err := cmd.Output()
-		log.Println(output)
-		if err != nil {
-			log.Println("Failed to capture still image with command:", imgCmd)
-			return nil, err
-		}
+	if conf.Backend == "gphoto2" {
+		return NewGphoto2Camera(conf, dir), nil
 	}
-
-	log.Println("Captured still image")
-
-	finalLoc := BuildFileName(imgLoc)
-	tiff, err := os.ReadFile(finalLoc)
-	return tiff, err
+	return NewVideoCamera(conf, dir), nil
 }
 
-func BuildFileName(name string) string {
-	return fmt.Sprintf("%s%s", name, os.Getenv("STILL_IMG_EXT"))
+// mimeTypes are the MIME types of the formats scans are stored in.
+var mimeTypes = map[string]string{
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
 }
 
-func GetMimeType() string {
-	return os.Getenv("STILL_IMG_MIME")
+// MimeType is the MIME type of a scan file going by its extension. Files
+// with the configured still extension take the configured MIME type.
+func MimeType(conf config.CameraConfig, name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	if conf.StillMime != "" && ext == strings.ToLower(conf.StillExt) {
+		return conf.StillMime
+	}
+	if t, ok := mimeTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+
+	return "application/octet-stream"
 }
@@ -0,0 +1,134 @@
+package camera
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstuessy/film-scanner/internal/config"
+)
+
+// StillParams are the per-capture values passed to the still command.
+type StillParams struct {
+	Project  string
+	Frame    int
+	Exposure string
+	ISO      string
+}
+
+// CommandError reports a failed still capture step along with what it
+// wrote to stderr.
+type CommandError struct {
+	Step   int
+	Argv   []string
+	Stderr string
+	Err    error
+}
+
+func (m *CommandError) Error() string {
+	msg := fmt.Sprintf("Still capture step %d (%s) failed: %s", m.Step, strings.Join(m.Argv, " "), m.Err)
+	if m.Stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, m.Stderr)
+	}
+	return msg
+}
+
+func (m *CommandError) Unwrap() error {
+	return m.Err
+}
+
+// stillVariables builds the template variables for a capture, see
+// config.StillVariables.
+func stillVariables(imgLoc string, ext string, params StillParams) map[string]string {
+	return map[string]string{
+		"image":    imgLoc,
+		"ext":      ext,
+		"exposure": params.Exposure,
+		"iso":      params.ISO,
+		"frame":    strconv.Itoa(params.Frame),
+		"project":  params.Project,
+	}
+}
+
+// expandTemplate replaces each {name} in s with its variable in one pass, so
+// placeholders within the values are left as they are. Unknown names are
+// kept, though config validation rejects them up front.
+func expandTemplate(s string, vars map[string]string) string {
+	return config.TemplateVariable.ReplaceAllStringFunc(s, func(match string) string {
+		if value, ok := vars[match[1:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// runStillSteps runs each step in order, stopping at the first failure or
+// when a step exceeds its timeout, or defaultTimeout if it has none.
+func runStillSteps(ctx context.Context, steps []config.CommandStep, defaultTimeout time.Duration, vars map[string]string) error {
+	for i, step := range steps {
+		argv := make([]string, len(step.Argv))
+		for j, arg := range step.Argv {
+			argv[j] = expandTemplate(arg, vars)
+		}
+
+		timeout := step.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+
+		log.Println("Capturing still image with command:", strings.Join(argv, " "))
+
+		if err := runStillStep(ctx, argv, timeout); err != nil {
+			err.Step = i
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runStillStep(ctx context.Context, argv []string, timeout time.Duration) *CommandError {
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(stepCtx, argv[0], argv[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if stdout.Len() > 0 {
+		log.Println(strings.TrimSpace(stdout.String()))
+	}
+
+	if stepCtx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("timed out after %s", timeout))
+	}
+	if err != nil {
+		return &CommandError{Argv: argv, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+
+	return nil
+}
+
+// readStillOutput reads the file written by the still command, failing if
+// it is missing or empty.
+func readStillOutput(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Still command did not write %s", path))
+	}
+
+	if info.Size() == 0 {
+		return nil, errors.New(fmt.Sprintf("Still command wrote an empty file %s", path))
+	}
+
+	return os.ReadFile(path)
+}
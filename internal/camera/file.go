@@ -0,0 +1,123 @@
+package camera
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dstuessy/film-scanner/internal/config"
+	"gocv.io/x/gocv"
+)
+
+const defaultFileCameraWidth = 640
+const defaultFileCameraHeight = 480
+
+// FileCamera serves a still image from disk as both the preview and the
+// captured scan, so the app can run without a camera attached. When no file
+// is configured it serves a synthetic test pattern instead.
+type FileCamera struct {
+	conf  config.CameraConfig
+	frame ImageData
+	open  bool
+}
+
+func NewFileCamera(conf config.CameraConfig) *FileCamera {
+	return &FileCamera{conf: conf}
+}
+
+func (c *FileCamera) IsOpen() bool {
+	return c.open
+}
+
+func (c *FileCamera) Open() error {
+	if c.open {
+		return nil
+	}
+
+	if c.conf.File == "" {
+		c.frame = testPattern(c.conf.Width, c.conf.Height)
+		c.open = true
+		return nil
+	}
+
+	mat := gocv.IMRead(c.conf.File, gocv.IMReadColor)
+	defer mat.Close()
+	if mat.Empty() {
+		return errors.New(fmt.Sprintf("Failed to read camera file %s", c.conf.File))
+	}
+
+	c.frame = DataFromMat(mat)
+	c.open = true
+
+	return nil
+}
+
+func (c *FileCamera) Close() error {
+	c.open = false
+	return nil
+}
+
+func (c *FileCamera) ReadFrame() (ImageData, error) {
+	if !c.open {
+		return ImageData{}, errors.New("Camera is not open")
+	}
+
+	data := make([]byte, len(c.frame.Data))
+	copy(data, c.frame.Data)
+
+	return ImageData{Rows: c.frame.Rows, Cols: c.frame.Cols, Data: data}, nil
+}
+
+func (c *FileCamera) CaptureStill(params StillParams) (Still, error) {
+	if c.conf.File != "" {
+		data, err := os.ReadFile(c.conf.File)
+		if err != nil {
+			return Still{}, err
+		}
+		return Still{Data: data, Ext: strings.ToLower(filepath.Ext(c.conf.File))}, nil
+	}
+
+	ext := c.conf.StillExt
+	if ext == "" {
+		ext = ".jpg"
+	}
+
+	data, err := EncodeImage(testPattern(c.conf.Width, c.conf.Height), ext)
+	if err != nil {
+		return Still{}, err
+	}
+	return Still{Data: data, Ext: ext}, nil
+}
+
+func (c *FileCamera) Capabilities() Capabilities {
+	return Capabilities{
+		Name:    "file",
+		Preview: true,
+		Still:   true,
+		Width:   c.frame.Cols,
+		Height:  c.frame.Rows,
+	}
+}
+
+// testPattern builds an RGB gradient of the given size, or the default size
+// if none is given.
+func testPattern(cols, rows int) ImageData {
+	if cols <= 0 || rows <= 0 {
+		cols = defaultFileCameraWidth
+		rows = defaultFileCameraHeight
+	}
+
+	data := make([]byte, rows*cols*3)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			i := (y*cols + x) * 3
+			data[i] = byte(x * 255 / cols)
+			data[i+1] = byte(y * 255 / rows)
+			data[i+2] = byte(255 - x*255/cols)
+		}
+	}
+
+	return ImageData{Rows: rows, Cols: cols, Data: data}
+}
@@ -0,0 +1,116 @@
+package camera
+
+import (
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// FocusPeakingThreshold is the Laplacian response above which a pixel is
+// highlighted as in focus.
+var FocusPeakingThreshold float32 = 40
+
+// FocusMetric is the sharpness of the latest analysed preview frame, along
+// with the sharpest value seen since the peak was last reset.
+type FocusMetric struct {
+	Sharpness float64
+	Peak      float64
+	Updated   time.Time
+}
+
+// staleViewer is how long the meters of a viewer that stopped streaming are
+// kept.
+const staleViewer = time.Minute
+
+var focusMu sync.Mutex
+
+// focus holds the metric of each viewer, as every stream has its own loupe.
+var focus = map[string]FocusMetric{}
+
+// AnalyseFocus scores the sharpness of a frame as the variance of its
+// Laplacian, and records the score of the viewer for GetFocus. With peaking
+// set, pixels with a strong edge response are highlighted in red in the
+// returned frame.
+func AnalyseFocus(viewer string, img ImageData, peaking bool) (ImageData, float64, error) {
+	mat, err := MatFromData(img)
+	defer mat.Close()
+	if err != nil {
+		return ImageData{}, 0, err
+	}
+
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(mat, &gray, gocv.ColorBGRToGray)
+
+	lap := gocv.NewMat()
+	defer lap.Close()
+	gocv.Laplacian(gray, &lap, gocv.MatTypeCV16S, 3, 1, 0, gocv.BorderDefault)
+
+	mean := gocv.NewMat()
+	defer mean.Close()
+	stdDev := gocv.NewMat()
+	defer stdDev.Close()
+	gocv.MeanStdDev(lap, &mean, &stdDev)
+
+	sd := stdDev.GetDoubleAt(0, 0)
+	sharpness := sd * sd
+
+	recordSharpness(viewer, sharpness)
+
+	if !peaking {
+		return img, sharpness, nil
+	}
+
+	edges := gocv.NewMat()
+	defer edges.Close()
+	gocv.ConvertScaleAbs(lap, &edges, 1, 0)
+	gocv.Threshold(edges, &edges, FocusPeakingThreshold, 255, gocv.ThresholdBinary)
+
+	highlight := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(0, 0, 255, 0), mat.Rows(), mat.Cols(), gocv.MatTypeCV8UC3)
+	defer highlight.Close()
+	highlight.CopyToWithMask(&mat, edges)
+
+	return DataFromMat(mat), sharpness, nil
+}
+
+func recordSharpness(viewer string, sharpness float64) {
+	focusMu.Lock()
+	defer focusMu.Unlock()
+
+	now := time.Now()
+	for v, metric := range focus {
+		if now.Sub(metric.Updated) > staleViewer {
+			delete(focus, v)
+		}
+	}
+
+	metric := focus[viewer]
+	metric.Sharpness = sharpness
+	if sharpness > metric.Peak {
+		metric.Peak = sharpness
+	}
+	metric.Updated = now
+	focus[viewer] = metric
+}
+
+func GetFocus(viewer string) FocusMetric {
+	focusMu.Lock()
+	defer focusMu.Unlock()
+
+	return focus[viewer]
+}
+
+// ResetFocusPeak starts tracking the sharpest frame of the viewer afresh,
+// e.g. when the film holder has been moved.
+func ResetFocusPeak(viewer string) {
+	focusMu.Lock()
+	defer focusMu.Unlock()
+
+	metric, ok := focus[viewer]
+	if !ok {
+		return
+	}
+	metric.Peak = metric.Sharpness
+	focus[viewer] = metric
+}
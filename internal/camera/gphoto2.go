@@ -0,0 +1,217 @@
+package camera
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dstuessy/film-scanner/internal/config"
+	"gocv.io/x/gocv"
+)
+
+// rawExts are the extensions of camera RAW files downloaded by gphoto2.
+var rawExts = []string{".arw", ".cr2", ".cr3", ".dng", ".nef", ".orf", ".pef", ".raf", ".rw2"}
+
+// Gphoto2Camera drives a tethered camera through the gphoto2 command line
+// tool, using live view for the preview and capture-and-download for stills.
+type Gphoto2Camera struct {
+	conf config.CameraConfig
+	dir  string
+	open bool
+}
+
+// NewGphoto2Camera returns a camera downloading its stills to dir.
+func NewGphoto2Camera(conf config.CameraConfig, dir string) *Gphoto2Camera {
+	return &Gphoto2Camera{conf: conf, dir: dir}
+}
+
+func (c *Gphoto2Camera) IsOpen() bool {
+	return c.open
+}
+
+// Open checks that a camera is connected. Live view starts with the first
+// preview frame.
+func (c *Gphoto2Camera) Open() error {
+	if c.open {
+		return nil
+	}
+
+	out, err := c.run(context.Background(), "--auto-detect")
+	if err != nil {
+		return err
+	}
+
+	// the output lists a header and a separator line before any cameras
+	if len(strings.Split(strings.TrimSpace(string(out)), "\n")) < 3 {
+		return errors.New("No camera detected by gphoto2")
+	}
+
+	c.open = true
+
+	return nil
+}
+
+func (c *Gphoto2Camera) Close() error {
+	c.open = false
+	return nil
+}
+
+func (c *Gphoto2Camera) ReadFrame() (ImageData, error) {
+	if !c.open {
+		return ImageData{}, errors.New("Camera is not open")
+	}
+
+	jpeg, err := c.run(context.Background(), "--capture-preview", "--stdout")
+	if err != nil {
+		return ImageData{}, err
+	}
+
+	mat, err := gocv.IMDecode(jpeg, gocv.IMReadColor)
+	if err != nil {
+		return ImageData{}, err
+	}
+	defer mat.Close()
+
+	if mat.Empty() {
+		return ImageData{}, errors.New("Empty live view frame")
+	}
+
+	return DataFromMat(mat), nil
+}
+
+// CaptureStill captures and downloads an image, returned with the extension
+// it was downloaded with. When the camera shoots RAW+JPEG the JPEG is
+// returned, carrying the RAW as its original if that is the primary format.
+func (c *Gphoto2Camera) CaptureStill(params StillParams) (Still, error) {
+	imgName := fmt.Sprintf(c.conf.StillName, time.Now().Unix())
+	imgLoc := filepath.Join(c.dir, imgName)
+
+	args := make([]string, 0)
+	if params.Exposure != "" {
+		args = append(args, "--set-config-value", fmt.Sprintf("shutterspeed=%s", params.Exposure))
+	}
+	if params.ISO != "" {
+		args = append(args, "--set-config-value", fmt.Sprintf("iso=%s", params.ISO))
+	}
+	args = append(args,
+		"--capture-image-and-download",
+		"--force-overwrite",
+		"--filename", fmt.Sprintf("%s.%%C", imgLoc),
+	)
+
+	log.Println("Capturing still image with gphoto2")
+
+	if _, err := c.run(context.Background(), args...); err != nil {
+		log.Println("Failed to capture still image")
+		return Still{}, err
+	}
+
+	files, err := filepath.Glob(fmt.Sprintf("%s.*", imgLoc))
+	if err != nil {
+		return Still{}, err
+	}
+	defer func() {
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				log.Println("Failed to remove captured still:", err)
+			}
+		}
+	}()
+
+	still := pickStill(files, c.conf.Gphoto2.Primary)
+	if still == "" {
+		return Still{}, errors.New(fmt.Sprintf("gphoto2 did not download an image to %s", imgLoc))
+	}
+
+	log.Println("Captured still image", still)
+
+	data, err := readStillOutput(still)
+	if err != nil {
+		return Still{}, err
+	}
+	captured := Still{Data: data, Ext: strings.ToLower(filepath.Ext(still))}
+
+	if !IsRaw(still) {
+		return captured, nil
+	}
+
+	// RAW files cannot be decoded for processing, so the JPEG of the pair is
+	// processed in their place
+	jpeg := pickStill(files, "jpeg")
+	if IsRaw(jpeg) {
+		return captured, nil
+	}
+
+	jpegData, err := readStillOutput(jpeg)
+	if err != nil {
+		return Still{}, err
+	}
+
+	return Still{Data: jpegData, Ext: strings.ToLower(filepath.Ext(jpeg)), Original: &captured}, nil
+}
+
+func (c *Gphoto2Camera) Capabilities() Capabilities {
+	return Capabilities{
+		Name:    "gphoto2",
+		Preview: true,
+		Still:   true,
+	}
+}
+
+// run invokes gphoto2 with a timeout, returning its stdout.
+func (c *Gphoto2Camera) run(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.conf.Gphoto2.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.conf.Gphoto2.Path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("timed out after %s", c.conf.Gphoto2.Timeout))
+	}
+	if err != nil {
+		return nil, &CommandError{
+			Argv:   append([]string{c.conf.Gphoto2.Path}, args...),
+			Stderr: strings.TrimSpace(stderr.String()),
+			Err:    err,
+		}
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// pickStill chooses the downloaded file of the primary format, "raw" or
+// "jpeg", falling back to whichever file was downloaded.
+func pickStill(files []string, primary string) string {
+	fallback := ""
+
+	for _, f := range files {
+		if IsRaw(f) == (primary == "raw") {
+			return f
+		}
+		fallback = f
+	}
+
+	return fallback
+}
+
+// IsRaw reports whether name is a camera RAW file going by its extension.
+func IsRaw(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, r := range rawExts {
+		if ext == r {
+			return true
+		}
+	}
+	return false
+}
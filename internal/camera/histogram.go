@@ -0,0 +1,80 @@
+package camera
+
+import (
+	"sync"
+	"time"
+)
+
+// HighlightClipLevel and ShadowClipLevel are the channel values at or beyond
+// which a pixel counts as clipped.
+var HighlightClipLevel byte = 255
+var ShadowClipLevel byte = 0
+
+// Histogram counts the RGB and luma values of a frame, along with the
+// percentage of pixels with a clipped channel.
+type Histogram struct {
+	Red               [256]int
+	Green             [256]int
+	Blue              [256]int
+	Luma              [256]int
+	ShadowClipping    float64
+	HighlightClipping float64
+	Updated           time.Time
+}
+
+var histogramMu sync.Mutex
+
+// histograms holds the histogram of each viewer, as every stream has its
+// own loupe.
+var histograms = map[string]Histogram{}
+
+// AnalyseHistogram computes the histogram of a frame and records it as the
+// viewer's for GetHistogram.
+func AnalyseHistogram(viewer string, img ImageData) Histogram {
+	h := Histogram{}
+
+	pixels := 0
+	shadows := 0
+	highlights := 0
+
+	for i := 0; i+2 < len(img.Data); i += 3 {
+		r, g, b := img.Data[i], img.Data[i+1], img.Data[i+2]
+
+		h.Red[r]++
+		h.Green[g]++
+		h.Blue[b]++
+		h.Luma[(299*int(r)+587*int(g)+114*int(b))/1000]++
+
+		if r <= ShadowClipLevel || g <= ShadowClipLevel || b <= ShadowClipLevel {
+			shadows++
+		}
+		if r >= HighlightClipLevel || g >= HighlightClipLevel || b >= HighlightClipLevel {
+			highlights++
+		}
+		pixels++
+	}
+
+	if pixels > 0 {
+		h.ShadowClipping = float64(shadows) / float64(pixels) * 100
+		h.HighlightClipping = float64(highlights) / float64(pixels) * 100
+	}
+	h.Updated = time.Now()
+
+	histogramMu.Lock()
+	for v, old := range histograms {
+		if h.Updated.Sub(old.Updated) > staleViewer {
+			delete(histograms, v)
+		}
+	}
+	histograms[viewer] = h
+	histogramMu.Unlock()
+
+	return h
+}
+
+func GetHistogram(viewer string) Histogram {
+	histogramMu.Lock()
+	defer histogramMu.Unlock()
+
+	return histograms[viewer]
+}
@@ -0,0 +1,258 @@
+package camera
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// State is what the camera manager is doing with the camera.
+type State string
+
+const (
+	StateClosed    State = "closed"
+	StateIdle      State = "idle"
+	StateStreaming State = "streaming"
+	StateCapturing State = "capturing"
+)
+
+// Status is the state of the camera manager, with the last error opening or
+// reading the camera, if any.
+type Status struct {
+	State State
+	Error string
+}
+
+// StillFunc takes a still with the camera held by a capture.
+type StillFunc func(params StillParams) (Still, error)
+
+// ErrBusy is returned by Capture while another capture holds the camera.
+var ErrBusy = errors.New("Camera is busy capturing")
+
+// reopenInterval spaces out attempts to open a camera that failed to open.
+var reopenInterval = 2 * time.Second
+
+type captureRequest struct {
+	fn   func(still StillFunc) error
+	done chan error
+}
+
+var captures = make(chan captureRequest)
+
+var stops = make(chan chan error)
+
+var statusLock sync.Mutex
+
+var status = Status{State: StateClosed}
+
+var running bool
+
+// stopped is closed when the manager exits, so requests sent to it give up.
+var stopped chan struct{}
+
+func setStatus(state State, err error) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	status.State = state
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+	}
+}
+
+func GetStatus() Status {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	return status
+}
+
+// managerStopped returns the channel closed once the manager exits, or nil
+// if it is not running.
+func managerStopped() chan struct{} {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	if !running {
+		return nil
+	}
+	return stopped
+}
+
+// startManager starts the goroutine owning c. Only it opens, reads and
+// closes the camera, so the preview and captures take turns through the
+// requests it serves. The camera is closed while nobody subscribes to the
+// preview.
+func startManager(c Camera) error {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	if running {
+		return errors.New("Camera manager already running")
+	}
+	running = true
+	stopped = make(chan struct{})
+
+	go manage(c, stopped)
+
+	return nil
+}
+
+func manage(c Camera, stopped chan struct{}) {
+	defer close(stopped)
+
+	var lastOpen time.Time
+
+	// set while a capture holds the camera
+	var capture captureRequest
+	var finished chan error
+
+	open := func() {
+		if c.IsOpen() || time.Since(lastOpen) < reopenInterval {
+			return
+		}
+		lastOpen = time.Now()
+
+		if err := c.Open(); err != nil {
+			log.Println(err)
+			setStatus(StateClosed, err)
+			return
+		}
+		setStatus(StateStreaming, nil)
+	}
+
+	ticker := time.NewTicker(FrameInterval)
+	defer ticker.Stop()
+
+	pause := func() {
+		if GetStatus().State == StateIdle {
+			return
+		}
+		log.Println("Pausing preview, nobody is watching")
+
+		if err := c.Close(); err != nil {
+			log.Println(err)
+		}
+		clearFrame()
+		lastOpen = time.Time{}
+		setStatus(StateIdle, nil)
+	}
+
+	setStatus(StateIdle, nil)
+
+	for {
+		select {
+		case <-ticker.C:
+			if finished != nil {
+				continue
+			}
+
+			if countSubscribers() == 0 {
+				pause()
+				continue
+			}
+
+			open()
+			if !c.IsOpen() {
+				continue
+			}
+
+			img, err := c.ReadFrame()
+			if err != nil {
+				log.Println(err)
+				setStatus(StateStreaming, err)
+				continue
+			}
+			broadcast(img)
+
+		case req := <-captures:
+			if finished != nil {
+				req.done <- ErrBusy
+				continue
+			}
+
+			log.Println("Pausing preview for capture")
+
+			if err := c.Close(); err != nil {
+				req.done <- err
+				continue
+			}
+			clearFrame()
+			setStatus(StateCapturing, nil)
+
+			capture = req
+			finished = make(chan error, 1)
+			go func(fn func(still StillFunc) error, finished chan error) {
+				finished <- fn(c.CaptureStill)
+			}(req.fn, finished)
+
+		case err := <-finished:
+			capture.done <- err
+			capture = captureRequest{}
+			finished = nil
+
+			log.Println("Resuming preview")
+
+			lastOpen = time.Time{}
+			setStatus(StateIdle, nil)
+
+		case done := <-stops:
+			if finished != nil {
+				capture.done <- <-finished
+			}
+
+			log.Println("Closing Camera")
+
+			err := c.Close()
+			clearFrame()
+			setStatus(StateClosed, nil)
+
+			statusLock.Lock()
+			running = false
+			statusLock.Unlock()
+
+			done <- err
+			return
+		}
+	}
+}
+
+// Capture pauses the preview and runs fn with sole use of the camera,
+// resuming the preview once fn returns. A capture requested while another is
+// running fails with ErrBusy rather than waiting for it.
+func Capture(fn func(still StillFunc) error) error {
+	stopped := managerStopped()
+	if stopped == nil {
+		return errors.New("Camera manager not running")
+	}
+
+	req := captureRequest{fn: fn, done: make(chan error, 1)}
+	select {
+	case captures <- req:
+	case <-stopped:
+		return errors.New("Camera manager stopped")
+	}
+
+	// the manager answers every request it takes, even when stopping
+	return <-req.done
+}
+
+// CloseCamera stops the camera manager, waiting for a running capture, and
+// closes the camera.
+func CloseCamera() error {
+	stopped := managerStopped()
+	if stopped == nil {
+		return nil
+	}
+
+	done := make(chan error, 1)
+	select {
+	case stops <- done:
+	case <-stopped:
+		return nil
+	}
+
+	return <-done
+}
@@ -1,57 +1,76 @@
 package camera
 
-import (
-	"errors"
-	"gocv.io/x/gocv"
-	"log"
-	"time"
-)
-
-var stream = make(chan ImageData)
-
-func StartStream() error {
-	lastFrame := ImageData{}
-
-	OpenCamera()
-
-	go func() {
-		for {
-			if !IsCameraOpen() {
-				stream <- lastFrame
-				continue
-			}
-
-			img, err := captureFrame()
-			if err != nil {
-				log.Println(err)
-				log.Println("Closing stream")
-				continue
-			}
-
-			stream <- img
-			lastFrame = img
-
-			time.Sleep(FrameInterval)
-		}
-	}()
+import "sync"
 
-	return nil
-}
+// subscribers each hold the latest preview frame they have not taken yet,
+// older frames are dropped so a slow viewer never holds up the others.
+var subscribers = map[chan ImageData]bool{}
+
+var subscribersLock sync.Mutex
 
-func GetStream() chan ImageData {
-	return stream
+var latestFrame ImageData
+
+// StartStream starts the camera manager, which opens c and broadcasts
+// preview frames to subscribers.
+func StartStream(c Camera) error {
+	return startManager(c)
 }
 
-func captureFrame() (ImageData, error) {
-	mat := gocv.NewMat()
-	defer mat.Close()
+// Subscribe returns a channel receiving the latest preview frame, starting
+// with the last one read if any. The preview is only read while there are
+// subscribers, so it must be passed to Unsubscribe once done.
+func Subscribe() chan ImageData {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
 
-	if ok := webcam.Read(&mat); !ok {
-		return ImageData{}, errors.New("Cannot read from webcam")
-	}
-	if mat.Empty() {
-		return ImageData{}, errors.New("Empty frame")
+	frames := make(chan ImageData, 1)
+	if len(latestFrame.Data) > 0 {
+		frames <- latestFrame
 	}
+	subscribers[frames] = true
+
+	return frames
+}
+
+func Unsubscribe(frames chan ImageData) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	delete(subscribers, frames)
+}
+
+func countSubscribers() int {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
 
-	return DataFromMat(mat), nil
+	return len(subscribers)
+}
+
+// clearFrame forgets the last frame once the preview stops, so new
+// subscribers wait for a fresh one.
+func clearFrame() {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	latestFrame = ImageData{}
+}
+
+// broadcast replaces the frame waiting in each subscription with img.
+func broadcast(img ImageData) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	latestFrame = img
+
+	for frames := range subscribers {
+		select {
+		case <-frames:
+		default:
+		}
+
+		select {
+		case frames <- img:
+		default:
+		}
+	}
 }
@@ -3,18 +3,19 @@ package camera
 import (
 	"log"
 	"os"
-)
 
-var tmpdir string
+	"github.com/dstuessy/film-scanner/internal/config"
+)
 
-func SetupTempDir() error {
-	dir, err := os.MkdirTemp("", os.Getenv("STILL_IMG_DIR"))
+// makeTempDir creates the directory stills are written to before they are
+// cached.
+func makeTempDir(conf config.CameraConfig) (string, error) {
+	dir, err := os.MkdirTemp("", conf.StillDir)
 	if err != nil {
 		log.Println("Error creating temp dir:", err)
-		return err
+		return "", err
 	}
 	log.Println("Created temp dir:", dir)
 
-	tmpdir = dir
-	return nil
+	return dir, nil
 }
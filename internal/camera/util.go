@@ -2,38 +2,86 @@ package camera
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"strings"
 
 	"gocv.io/x/gocv"
 )
 
+// DataFromMat converts an 8 or 16-bit BGR or greyscale Mat to image data.
 func DataFromMat(bgr gocv.Mat) ImageData {
+	depth := 8 * bgr.ElemSize() / bgr.Channels()
+
+	if bgr.Channels() == 1 {
+		return ImageData{
+			Rows:     bgr.Rows(),
+			Cols:     bgr.Cols(),
+			Data:     bgr.ToBytes(),
+			Depth:    depth,
+			Channels: 1,
+		}
+	}
+
 	rgb := gocv.NewMat()
 	defer rgb.Close()
 	gocv.CvtColor(bgr, &rgb, gocv.ColorBGRToRGB)
 
 	return ImageData{
-		Rows: rgb.Rows(),
-		Cols: rgb.Cols(),
-		Data: rgb.ToBytes(),
+		Rows:     rgb.Rows(),
+		Cols:     rgb.Cols(),
+		Data:     rgb.ToBytes(),
+		Depth:    depth,
+		Channels: 3,
 	}
 }
 
+// ResizeData scales image data. Enlarged images use nearest neighbour
+// interpolation so that grain stays crisp when inspected up close.
 func ResizeData(img ImageData, scale float64) (ImageData, error) {
-	mat, err := gocv.NewMatFromBytes(img.Rows, img.Cols, gocv.MatTypeCV8UC3, img.Data)
+	mat, err := MatFromData(img)
 	defer mat.Close()
 	if err != nil {
 		return ImageData{}, err
 	}
 
-	gocv.Resize(mat, &mat, image.Point{}, scale, scale, gocv.InterpolationArea)
+	interpolation := gocv.InterpolationArea
+	if scale > 1 {
+		interpolation = gocv.InterpolationNearestNeighbor
+	}
+
+	gocv.Resize(mat, &mat, image.Point{}, scale, scale, interpolation)
 
 	return DataFromMat(mat), nil
 }
 
+// RegionData copies a region out of image data.
+func RegionData(img ImageData, r image.Rectangle) (ImageData, error) {
+	if !r.In(image.Rect(0, 0, img.Cols, img.Rows)) || r.Empty() {
+		return ImageData{}, errors.New(fmt.Sprintf("Region %v is outside of the %dx%d frame", r, img.Cols, img.Rows))
+	}
+
+	px := img.PixelSize()
+	region := ImageData{
+		Rows:     r.Dy(),
+		Cols:     r.Dx(),
+		Data:     make([]byte, r.Dx()*r.Dy()*px),
+		Depth:    img.Depth,
+		Channels: img.Channels,
+	}
+
+	rowLen := r.Dx() * px
+	for y := 0; y < r.Dy(); y++ {
+		src := ((r.Min.Y+y)*img.Cols + r.Min.X) * px
+		copy(region.Data[y*rowLen:(y+1)*rowLen], img.Data[src:src+rowLen])
+	}
+
+	return region, nil
+}
+
 func EncodeJpeg(img ImageData) ([]byte, error) {
-	mat, err := gocv.NewMatFromBytes(img.Rows, img.Cols, gocv.MatTypeCV8UC3, img.Data)
+	mat, err := MatFromData(img)
 	defer mat.Close()
 	if err != nil {
 		return nil, err
@@ -59,9 +107,11 @@ func drawDebugRects(img *gocv.Mat, rects []gocv.RotatedRect, minCropWidth, minCr
 		{X: centerX - minCropWidth/2, Y: centerY + minCropHeight/2},
 	}
 	minContour := gocv.NewPointVectorFromPoints(points)
+	defer minContour.Close()
 	cs := gocv.NewPointsVector()
 	cs.Append(minContour)
 	gocv.DrawContours(img, cs, -1, color.RGBA{255, 0, 0, 1}, 2)
+	cs.Close()
 
 	// drawing the expected maximum crop area
 	points = []image.Point{
@@ -71,9 +121,11 @@ func drawDebugRects(img *gocv.Mat, rects []gocv.RotatedRect, minCropWidth, minCr
 		{X: centerX - maxCropWidth/2, Y: centerY + maxCropHeight/2},
 	}
 	maxContour := gocv.NewPointVectorFromPoints(points)
+	defer maxContour.Close()
 	cs = gocv.NewPointsVector()
 	cs.Append(maxContour)
 	gocv.DrawContours(img, cs, -1, color.RGBA{0, 0, 255, 1}, 2)
+	cs.Close()
 
 	for _, r := range rects {
 		gocv.Rectangle(img, r.BoundingRect, color.RGBA{0, 255, 0, 1}, 2)
@@ -136,6 +188,7 @@ func findLargestContourRect(img gocv.Mat) gocv.RotatedRect {
 
 		if area > largestArea {
 			adequateRect = gocv.MinAreaRect(contour)
+			largestArea = area
 		}
 	}
 
@@ -172,26 +225,43 @@ func getSmallestRect(rects []gocv.RotatedRect) gocv.RotatedRect {
 	return smallestRect
 }
 
-func AutoCropFrame(img gocv.Mat, minCropRatio, maxCropRatio float64, trim []float64) (gocv.Mat, gocv.Mat, error) {
+// CropDetection holds the candidate film frames found by DetectCrop along
+// with the expected minimum and maximum crop sizes they were checked
+// against.
+type CropDetection struct {
+	Rects         []gocv.RotatedRect
+	MinCropWidth  int
+	MinCropHeight int
+	MaxCropWidth  int
+	MaxCropHeight int
+}
+
+// DetectCrop thresholds img at increasing levels and collects the largest
+// contour of each level whose area lies between the minimum and maximum
+// crop ratios of a 3:2 frame.
+func DetectCrop(img gocv.Mat, minCropRatio, maxCropRatio float64) CropDetection {
 	ignoreMask := createIgnoreMask(img)
 	defer ignoreMask.Close()
 
 	imgHeight := float64(img.Rows())
 	imgWidth := imgHeight * 1.5
 
-	minCropWidth := int(minCropRatio * imgWidth)
-	minCropHeight := int(minCropRatio * imgHeight)
-	maxCropWidth := int(maxCropRatio * imgWidth)
-	maxCropHeight := int(maxCropRatio * imgHeight)
+	d := CropDetection{
+		Rects:         make([]gocv.RotatedRect, 0),
+		MinCropWidth:  int(minCropRatio * imgWidth),
+		MinCropHeight: int(minCropRatio * imgHeight),
+		MaxCropWidth:  int(maxCropRatio * imgWidth),
+		MaxCropHeight: int(maxCropRatio * imgHeight),
+	}
 
-	minCropArea := minCropWidth * minCropHeight
-	maxCropArea := maxCropWidth * maxCropHeight
+	minCropArea := d.MinCropWidth * d.MinCropHeight
+	maxCropArea := d.MaxCropWidth * d.MaxCropHeight
 
-	cropRects := make([]gocv.RotatedRect, 0)
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
 
 	for threshold := 0; threshold <= 250; threshold += 5 {
-		gray := gocv.NewMat()
-		gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
 		t := thresholdImage(gray, threshold, ignoreMask)
 
 		r := findLargestContourRect(t)
@@ -204,40 +274,321 @@ func AutoCropFrame(img gocv.Mat, minCropRatio, maxCropRatio float64, trim []floa
 
 		c := gocv.NewPointVectorFromPoints(r.Points)
 		ca := gocv.ContourArea(c)
+		c.Close()
 		if ca < float64(minCropArea) || ca > float64(maxCropArea) {
 			continue
 		}
 
-		cropRects = append(cropRects, r)
+		d.Rects = append(d.Rects, r)
+	}
+
+	return d
+}
+
+// Draw marks the expected crop sizes and the candidate frames on img.
+func (d CropDetection) Draw(img *gocv.Mat) {
+	drawDebugRects(img, d.Rects, d.MinCropWidth, d.MinCropHeight, d.MaxCropWidth, d.MaxCropHeight)
+}
+
+// DetectCropData runs DetectCrop on image data.
+func DetectCropData(img ImageData, minCropRatio, maxCropRatio float64) (CropDetection, error) {
+	mat, err := MatFromData(img)
+	defer mat.Close()
+	if err != nil {
+		return CropDetection{}, err
+	}
+
+	return DetectCrop(mat, minCropRatio, maxCropRatio), nil
+}
+
+// DrawCropDetection returns a copy of img with the detection drawn on it.
+func DrawCropDetection(img ImageData, d CropDetection) (ImageData, error) {
+	mat, err := MatFromData(img)
+	defer mat.Close()
+	if err != nil {
+		return ImageData{}, err
 	}
 
+	d.Draw(&mat)
+
+	return DataFromMat(mat), nil
+}
+
+// Crop describes the film frame found by AutoCropFrame. Frame is the
+// detected frame and Rect the trimmed crop, both in the coordinates of the
+// source image after it has been rotated by Angle degrees about the frame
+// centre.
+type Crop struct {
+	Frame image.Rectangle
+	Rect  image.Rectangle
+	Angle float64
+}
+
+// uprightRect normalises the angle reported by MinAreaRect to the smallest
+// rotation that makes r upright, swapping width and height to match.
+func uprightRect(r gocv.RotatedRect) (float64, int, int) {
+	angle := r.Angle
+	width := r.Width
+	height := r.Height
+
+	if angle > 45 {
+		angle -= 90
+		width, height = height, width
+	} else if angle < -45 {
+		angle += 90
+		width, height = height, width
+	}
+
+	return angle, width, height
+}
+
+// AutoCropFrame detects the film frame in img and returns the cropped
+// region, a debug image of the candidate crops, and the applied crop. trim
+// removes a fraction of the frame width and height from each side of the
+// detected frame. With deskew set, img is rotated so the frame is upright
+// before cropping; otherwise the frame's bounding box is cropped as is.
+func AutoCropFrame(img gocv.Mat, minCropRatio, maxCropRatio float64, trim []float64, deskew bool) (gocv.Mat, gocv.Mat, Crop, error) {
+	// the frame is detected in an 8-bit copy, as denoising and histogram
+	// equalisation need one, and 16-bit images are cropped at full depth
 	debug := gocv.NewMat()
-	img.CopyTo(&debug)
-	drawDebugRects(&debug, cropRects, minCropWidth, minCropHeight, maxCropWidth, maxCropHeight)
+	if img.ElemSize()/img.Channels() == 2 {
+		img.ConvertToWithParams(&debug, gocv.MatTypeCV8UC3, 1.0/257, 0)
+	} else {
+		img.CopyTo(&debug)
+	}
+
+	detection := DetectCrop(debug, minCropRatio, maxCropRatio)
+	cropRects := detection.Rects
+	detection.Draw(&debug)
 
 	if len(cropRects) == 0 {
-		temp := gocv.NewMat()
-		defer temp.Close()
-		return temp, temp, errors.New("No crop found")
+		return gocv.NewMat(), debug, Crop{}, errors.New("No crop found")
 	}
 
 	smallestRect := getSmallestRect(cropRects)
 
-	cropped := img.Region(smallestRect.BoundingRect)
+	imgRect := image.Rect(0, 0, img.Cols(), img.Rows())
+	frame := smallestRect.BoundingRect
+	width := smallestRect.Width
+	height := smallestRect.Height
+	angle := 0.0
+
+	if deskew {
+		angle, width, height = uprightRect(smallestRect)
+
+		c := smallestRect.Center
+		frame = image.Rect(c.X-width/2, c.Y-height/2, c.X-width/2+width, c.Y-height/2+height)
+	}
+
+	upright := gocv.NewMat()
+	defer upright.Close()
 
-	if trim[0] > 0 {
-		tl := int(float64(smallestRect.Width) * trim[0])
-		tr := cropped.Cols() - tl
-		tc := image.Rect(tl, 0, tr, cropped.Rows())
-		cropped = cropped.Region(tc)
+	if angle != 0 {
+		m := gocv.GetRotationMatrix2D(smallestRect.Center, angle, 1)
+		defer m.Close()
+		gocv.WarpAffineWithParams(img, &upright, m, image.Pt(img.Cols(), img.Rows()), gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{0, 0, 0, 0})
+	} else {
+		img.CopyTo(&upright)
 	}
 
-	if trim[1] > 0 {
-		tt := int(float64(smallestRect.Height) * trim[1])
-		tb := cropped.Rows() - tt
-		tc := image.Rect(0, tt, cropped.Cols(), tb)
-		cropped = cropped.Region(tc)
+	bounds := frame.Intersect(imgRect)
+
+	trimX := int(float64(width) * trim[0])
+	trimY := int(float64(height) * trim[1])
+	cropRect := image.Rect(bounds.Min.X+trimX, bounds.Min.Y+trimY, bounds.Max.X-trimX, bounds.Max.Y-trimY)
+
+	if cropRect.Empty() {
+		return gocv.NewMat(), debug, Crop{}, errors.New("Crop is empty after trimming")
+	}
+
+	return upright.Region(cropRect), debug, Crop{Frame: bounds, Rect: cropRect, Angle: angle}, nil
+}
+
+// MatFromData converts RGB image data to a BGR Mat, or greyscale data to a
+// single channel Mat. The caller must close the returned Mat.
+func MatFromData(img ImageData) (gocv.Mat, error) {
+	mt := gocv.MatTypeCV8U
+	if img.BitDepth() == 16 {
+		mt = gocv.MatTypeCV16U
+	}
+
+	if img.NumChannels() == 1 {
+		return gocv.NewMatFromBytes(img.Rows, img.Cols, mt+gocv.MatChannels1, img.Data)
+	}
+
+	rgb, err := gocv.NewMatFromBytes(img.Rows, img.Cols, mt+gocv.MatChannels3, img.Data)
+	defer rgb.Close()
+	if err != nil {
+		return gocv.NewMat(), err
+	}
+
+	bgr := gocv.NewMat()
+	// swapping channels is symmetric, so this converts RGB back to BGR
+	gocv.CvtColor(rgb, &bgr, gocv.ColorBGRToRGB)
+
+	return bgr, nil
+}
+
+// DecodeImage decodes an encoded still such as a JPEG or TIFF to RGB, which
+// the processing stages work on. 16-bit stills such as PNGs keep their depth.
+func DecodeImage(buf []byte) (ImageData, error) {
+	mat, err := gocv.IMDecode(buf, gocv.IMReadColor|gocv.IMReadAnyDepth)
+	if err != nil {
+		return ImageData{}, err
+	}
+	defer mat.Close()
+
+	if mat.Empty() {
+		return ImageData{}, errors.New("Failed to decode still image")
+	}
+
+	return DataFromMat(mat), nil
+}
+
+// EncodeOptions tune the formats that have settings. Zero values keep
+// OpenCV's defaults.
+type EncodeOptions struct {
+	JpegQuality     int    // 1 to 100
+	JpegSubsampling string // one of JpegSubsamplings
+}
+
+// imwriteJpegSamplingFactor is OpenCV's IMWRITE_JPEG_SAMPLING_FACTOR, which
+// gocv does not name.
+const imwriteJpegSamplingFactor = 7
+
+// JpegSubsamplings map the chroma subsampling of JPEGs to OpenCV's sampling
+// factors.
+var JpegSubsamplings = map[string]int{
+	"444": 0x111111,
+	"422": 0x211111,
+	"420": 0x411111,
+}
+
+// EncodeImage encodes image data using the image format of ext.
+func EncodeImage(img ImageData, ext string) ([]byte, error) {
+	return EncodeImageWithOptions(img, ext, EncodeOptions{})
+}
+
+// EncodeImageWithOptions encodes image data using the image format of ext.
+// JPEG and WebP have no 16-bit mode, so deep images are reduced to 8 bits for
+// them, while PNG keeps 16 bits. WebP is written lossless.
+func EncodeImageWithOptions(img ImageData, ext string, opts EncodeOptions) ([]byte, error) {
+	params := make([]int, 0)
+
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		img = Data8Bit(img)
+		if opts.JpegQuality > 0 {
+			params = append(params, gocv.IMWriteJpegQuality, opts.JpegQuality)
+		}
+		if factor, ok := JpegSubsamplings[opts.JpegSubsampling]; ok {
+			params = append(params, imwriteJpegSamplingFactor, factor)
+		}
+	case ".webp":
+		img = Data8Bit(img)
+		// qualities above 100 select lossless compression
+		params = append(params, gocv.IMWriteWebpQuality, 101)
+	}
+
+	mat, err := MatFromData(img)
+	defer mat.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := gocv.IMEncodeWithParams(gocv.FileExt(ext), mat, params)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+
+	encoded := make([]byte, buf.Len())
+	copy(encoded, buf.GetBytes())
+
+	return encoded, nil
+}
+
+// Data8Bit reduces 16-bit image data to 8 bits by keeping the high byte of
+// every sample.
+func Data8Bit(img ImageData) ImageData {
+	if img.BitDepth() == 8 {
+		return img
+	}
+
+	out := ImageData{
+		Rows:     img.Rows,
+		Cols:     img.Cols,
+		Data:     make([]byte, len(img.Data)/2),
+		Depth:    8,
+		Channels: img.Channels,
+	}
+	for i := range out.Data {
+		out.Data[i] = img.Data[2*i+1]
+	}
+
+	return out
+}
+
+// GreyData keeps one channel of RGB image data whose channels are equal,
+// such as an inverted B&W negative.
+func GreyData(img ImageData) ImageData {
+	if img.NumChannels() == 1 {
+		return img
+	}
+
+	size := img.BitDepth() / 8
+	px := img.PixelSize()
+	out := ImageData{
+		Rows:     img.Rows,
+		Cols:     img.Cols,
+		Data:     make([]byte, img.Rows*img.Cols*size),
+		Depth:    img.Depth,
+		Channels: 1,
+	}
+	for i := 0; i < img.Rows*img.Cols; i++ {
+		copy(out.Data[i*size:(i+1)*size], img.Data[i*px:i*px+size])
+	}
+
+	return out
+}
+
+// RGBData spreads greyscale image data over three channels.
+func RGBData(img ImageData) ImageData {
+	if img.NumChannels() == 3 {
+		return img
+	}
+
+	size := img.BitDepth() / 8
+	out := ImageData{
+		Rows:     img.Rows,
+		Cols:     img.Cols,
+		Data:     make([]byte, img.Rows*img.Cols*size*3),
+		Depth:    img.Depth,
+		Channels: 3,
+	}
+	for i := 0; i < img.Rows*img.Cols; i++ {
+		for c := 0; c < 3; c++ {
+			copy(out.Data[(i*3+c)*size:(i*3+c+1)*size], img.Data[i*size:(i+1)*size])
+		}
+	}
+
+	return out
+}
+
+// CropData auto crops image data, see AutoCropFrame.
+func CropData(img ImageData, minCropRatio, maxCropRatio float64, trim []float64, deskew bool) (ImageData, Crop, error) {
+	mat, err := MatFromData(img)
+	defer mat.Close()
+	if err != nil {
+		return ImageData{}, Crop{}, err
+	}
+
+	cropped, debug, crop, err := AutoCropFrame(mat, minCropRatio, maxCropRatio, trim, deskew)
+	defer cropped.Close()
+	defer debug.Close()
+	if err != nil {
+		return ImageData{}, Crop{}, err
 	}
 
-	return cropped, debug, nil
+	return DataFromMat(cropped), crop, nil
 }
@@ -0,0 +1,138 @@
+package camera
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dstuessy/film-scanner/internal/config"
+	"gocv.io/x/gocv"
+)
+
+// VideoCamera previews through a gocv video device and captures stills by
+// running the still command while the device is closed.
+type VideoCamera struct {
+	conf   config.CameraConfig
+	dir    string
+	webcam *gocv.VideoCapture
+}
+
+// NewVideoCamera returns a camera writing its stills to dir.
+func NewVideoCamera(conf config.CameraConfig, dir string) *VideoCamera {
+	return &VideoCamera{conf: conf, dir: dir}
+}
+
+func (c *VideoCamera) IsOpen() bool {
+	if c.webcam == nil {
+		return false
+	}
+
+	return c.webcam.IsOpened()
+}
+
+func (c *VideoCamera) Open() error {
+	if c.webcam != nil {
+		return nil
+	}
+
+	webcam, err := gocv.OpenVideoCapture(c.conf.Device)
+	if err != nil {
+		return err
+	}
+
+	if c.conf.Width > 0 && c.conf.Height > 0 {
+		webcam.Set(gocv.VideoCaptureFrameWidth, float64(c.conf.Width))
+		webcam.Set(gocv.VideoCaptureFrameHeight, float64(c.conf.Height))
+	}
+
+	c.webcam = webcam
+
+	return nil
+}
+
+func (c *VideoCamera) Close() error {
+	if c.webcam == nil {
+		return nil
+	}
+
+	err := c.webcam.Close()
+	c.webcam = nil
+	return err
+}
+
+func (c *VideoCamera) ReadFrame() (ImageData, error) {
+	if c.webcam == nil {
+		return ImageData{}, errors.New("Camera is not open")
+	}
+
+	mat := gocv.NewMat()
+	defer mat.Close()
+
+	if ok := c.webcam.Read(&mat); !ok {
+		return ImageData{}, errors.New("Cannot read from webcam")
+	}
+	if mat.Empty() {
+		return ImageData{}, errors.New("Empty frame")
+	}
+
+	return DataFromMat(mat), nil
+}
+
+func (c *VideoCamera) CaptureStill(params StillParams) (Still, error) {
+	if c.webcam != nil {
+		return Still{}, errors.New("Camera is still open for streaming")
+	}
+
+	steps := c.conf.Steps()
+	if len(steps) == 0 {
+		return Still{}, errors.New("Still command not set")
+	}
+
+	imgName := fmt.Sprintf(c.conf.StillName, time.Now().Unix())
+	imgLoc := filepath.Join(c.dir, imgName)
+	vars := stillVariables(imgLoc, c.conf.StillExt, params)
+
+	if err := runStillSteps(context.Background(), steps, c.conf.StillTimeout, vars); err != nil {
+		log.Println("Failed to capture still image")
+		return Still{}, err
+	}
+
+	log.Println("Captured still image")
+
+	output := expandTemplate(c.conf.StillOutput, vars)
+	data, err := readStillOutput(output)
+	if err != nil {
+		return Still{}, err
+	}
+
+	if err := os.Remove(output); err != nil {
+		log.Println("Failed to remove captured still:", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(output))
+	if ext == "" {
+		ext = c.conf.StillExt
+	}
+
+	return Still{Data: data, Ext: ext}, nil
+}
+
+func (c *VideoCamera) Capabilities() Capabilities {
+	caps := Capabilities{
+		Name:    "video",
+		Preview: true,
+		Still:   len(c.conf.Steps()) > 0,
+	}
+
+	if c.webcam != nil {
+		caps.Width = int(c.webcam.Get(gocv.VideoCaptureFrameWidth))
+		caps.Height = int(c.webcam.Get(gocv.VideoCaptureFrameHeight))
+	}
+
+	return caps
+}
@@ -0,0 +1,356 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ServerConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+type AuthConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+type CacheConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type SettingsConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+// CommandStep is one program run to capture a still. Each argument may
+// contain the template variables listed in StillVariables.
+type CommandStep struct {
+	Argv    []string      `yaml:"argv"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Gphoto2Config drives a tethered camera. Primary picks the file kept when
+// the camera shoots RAW+JPEG, either "jpeg" or "raw". The JPEG is processed
+// either way, with a RAW primary kept as the original of the scan.
+type Gphoto2Config struct {
+	Path    string        `yaml:"path"`
+	Primary string        `yaml:"primary"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// StillVariables are the template variables available to still capture
+// steps and the still output path.
+var StillVariables = []string{"image", "ext", "exposure", "iso", "frame", "project"}
+
+// CameraConfig selects the capture backend and describes how stills are
+// taken. StillName is a format string receiving the capture time in Unix
+// seconds, e.g. "image-%d". Stills are captured by running StillSteps in
+// order, or the steps parsed from the legacy StillCommand string if none are
+// given, after which StillOutput must name the written file. Profile is the
+// path of an ICC profile made for the camera, which projects may embed in
+// their scans.
+type CameraConfig struct {
+	Backend      string        `yaml:"backend"`
+	File         string        `yaml:"file"`
+	Device       int           `yaml:"device"`
+	Width        int           `yaml:"width"`
+	Height       int           `yaml:"height"`
+	StillCommand string        `yaml:"still_command"`
+	StillSteps   []CommandStep `yaml:"still_steps"`
+	StillTimeout time.Duration `yaml:"still_timeout"`
+	StillOutput  string        `yaml:"still_output"`
+	StillName    string        `yaml:"still_name"`
+	StillDir     string        `yaml:"still_dir"`
+	StillExt     string        `yaml:"still_ext"`
+	StillMime    string        `yaml:"still_mime"`
+	Gphoto2      Gphoto2Config `yaml:"gphoto2"`
+	Make         string        `yaml:"make"`
+	Model        string        `yaml:"model"`
+	Profile      string        `yaml:"profile"`
+}
+
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Settings SettingsConfig `yaml:"settings"`
+	Camera   CameraConfig   `yaml:"camera"`
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (m *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid configuration:\n  %s", strings.Join(m.Problems, "\n  "))
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr: ":8080",
+		},
+		Camera: CameraConfig{
+			Backend:      "video",
+			StillTimeout: 60 * time.Second,
+			StillOutput:  "{image}{ext}",
+			StillName:    "image-%d",
+			StillDir:     "open-scanner-*",
+			Gphoto2: Gphoto2Config{
+				Path:    "gphoto2",
+				Primary: "jpeg",
+				Timeout: 30 * time.Second,
+			},
+		},
+	}
+}
+
+// Load reads the configuration file at path, if given, on top of the
+// defaults, then applies any environment overrides and validates the result.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to read config file %s: %s", path, err))
+		}
+
+		if err := yaml.Unmarshal(file, &c); err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse config file %s: %s", path, err))
+		}
+	}
+
+	problems := c.applyEnv()
+	problems = append(problems, c.validate()...)
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	return &c, nil
+}
+
+// applyEnv overrides settings with the environment variables used before
+// the config file existed, returning any values that failed to parse.
+func (c *Config) applyEnv() []string {
+	problems := make([]string, 0)
+
+	strs := []struct {
+		key   string
+		field *string
+	}{
+		{"SERVER_ADDR", &c.Server.Addr},
+		{"OAUTH_CLIENT_ID", &c.Auth.ClientID},
+		{"OAUTH_CLIENT_SECRET", &c.Auth.ClientSecret},
+		{"OAUTH_REDIRECT_URL", &c.Auth.RedirectURL},
+		{"CACHE_DIR", &c.Cache.Dir},
+		{"SETTINGS_DIR", &c.Settings.Dir},
+		{"CAMERA_BACKEND", &c.Camera.Backend},
+		{"CAMERA_FILE", &c.Camera.File},
+		{"STILL_IMG_COMMAND", &c.Camera.StillCommand},
+		{"STILL_IMG_NAME", &c.Camera.StillName},
+		{"STILL_IMG_DIR", &c.Camera.StillDir},
+		{"STILL_IMG_EXT", &c.Camera.StillExt},
+		{"STILL_IMG_MIME", &c.Camera.StillMime},
+		{"GPHOTO2_PATH", &c.Camera.Gphoto2.Path},
+		{"GPHOTO2_PRIMARY", &c.Camera.Gphoto2.Primary},
+		{"CAMERA_MAKE", &c.Camera.Make},
+		{"CAMERA_MODEL", &c.Camera.Model},
+		{"CAMERA_PROFILE", &c.Camera.Profile},
+	}
+	for _, s := range strs {
+		if v := os.Getenv(s.key); v != "" {
+			*s.field = v
+		}
+	}
+
+	ints := []struct {
+		key   string
+		field *int
+	}{
+		{"CAM_DEVICE", &c.Camera.Device},
+		{"CAM_WIDTH", &c.Camera.Width},
+		{"CAM_HEIGHT", &c.Camera.Height},
+	}
+	for _, i := range ints {
+		v := os.Getenv(i.key)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be a whole number, got %q", i.key, v))
+			continue
+		}
+		*i.field = n
+	}
+
+	return problems
+}
+
+func (c *Config) validate() []string {
+	problems := make([]string, 0)
+
+	if c.Server.Addr == "" {
+		problems = append(problems, "server.addr must be set")
+	}
+
+	if c.Auth.ClientID == "" {
+		problems = append(problems, "auth.client_id (OAUTH_CLIENT_ID) must be set")
+	}
+	if c.Auth.ClientSecret == "" {
+		problems = append(problems, "auth.client_secret (OAUTH_CLIENT_SECRET) must be set")
+	}
+	if c.Auth.RedirectURL == "" {
+		problems = append(problems, "auth.redirect_url (OAUTH_REDIRECT_URL) must be set")
+	}
+
+	if c.Cache.Dir == "" {
+		problems = append(problems, "cache.dir (CACHE_DIR) must be set")
+	}
+	if c.Settings.Dir == "" {
+		problems = append(problems, "settings.dir (SETTINGS_DIR) must be set")
+	}
+
+	problems = append(problems, c.Camera.validate()...)
+
+	return problems
+}
+
+func (c *CameraConfig) validate() []string {
+	problems := make([]string, 0)
+
+	switch c.Backend {
+	case "video":
+		if c.StillCommand == "" && len(c.StillSteps) == 0 {
+			problems = append(problems, "camera.still_steps or camera.still_command (STILL_IMG_COMMAND) must be set for the video backend")
+		}
+	case "file":
+		if c.File != "" {
+			if _, err := os.Stat(c.File); err != nil {
+				problems = append(problems, fmt.Sprintf("camera.file (CAMERA_FILE) %s cannot be read: %s", c.File, err))
+			}
+		}
+	case "gphoto2":
+		if c.Gphoto2.Path == "" {
+			problems = append(problems, "camera.gphoto2.path (GPHOTO2_PATH) must be set for the gphoto2 backend")
+		}
+		if c.Gphoto2.Primary != "jpeg" && c.Gphoto2.Primary != "raw" {
+			problems = append(problems, fmt.Sprintf("camera.gphoto2.primary (GPHOTO2_PRIMARY) must be \"jpeg\" or \"raw\", got %q", c.Gphoto2.Primary))
+		}
+		if c.Gphoto2.Timeout <= 0 {
+			problems = append(problems, "camera.gphoto2.timeout must be positive")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("camera.backend (CAMERA_BACKEND) must be \"video\", \"file\" or \"gphoto2\", got %q", c.Backend))
+	}
+
+	if c.Device < 0 {
+		problems = append(problems, "camera.device (CAM_DEVICE) must not be negative")
+	}
+
+	if (c.Width == 0) != (c.Height == 0) {
+		problems = append(problems, "camera.width (CAM_WIDTH) and camera.height (CAM_HEIGHT) must be set together")
+	}
+	if c.Width < 0 || c.Height < 0 {
+		problems = append(problems, "camera.width (CAM_WIDTH) and camera.height (CAM_HEIGHT) must not be negative")
+	}
+
+	// the still name receives the capture time, so it needs exactly one
+	// integer verb, which fmt reports as %!... when it is missing or wrong
+	if c.StillName == "" {
+		problems = append(problems, "camera.still_name (STILL_IMG_NAME) must be set")
+	} else if name := fmt.Sprintf(c.StillName, int64(0)); strings.Contains(name, "%!") {
+		problems = append(problems, fmt.Sprintf("camera.still_name (STILL_IMG_NAME) must contain exactly one integer verb such as %%d, got %q", c.StillName))
+	}
+
+	for i, step := range c.Steps() {
+		if len(step.Argv) == 0 || step.Argv[0] == "" {
+			problems = append(problems, fmt.Sprintf("camera.still_steps[%d] must name a program to run", i))
+		}
+		if step.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("camera.still_steps[%d].timeout must not be negative", i))
+		}
+		for _, arg := range step.Argv {
+			if name, ok := unknownVariable(arg); ok {
+				problems = append(problems, fmt.Sprintf("camera.still_steps[%d] uses unknown variable {%s}", i, name))
+			}
+		}
+	}
+
+	if c.StillTimeout <= 0 {
+		problems = append(problems, "camera.still_timeout must be positive")
+	}
+
+	if c.StillOutput == "" {
+		problems = append(problems, "camera.still_output must be set")
+	} else if name, ok := unknownVariable(c.StillOutput); ok {
+		problems = append(problems, fmt.Sprintf("camera.still_output uses unknown variable {%s}", name))
+	}
+
+	if c.Profile != "" {
+		if _, err := os.Stat(c.Profile); err != nil {
+			problems = append(problems, fmt.Sprintf("camera.profile (CAMERA_PROFILE) %s cannot be read: %s", c.Profile, err))
+		}
+	}
+
+	if c.StillExt != "" && !strings.HasPrefix(c.StillExt, ".") {
+		problems = append(problems, fmt.Sprintf("camera.still_ext (STILL_IMG_EXT) must start with a dot, got %q", c.StillExt))
+	}
+
+	return problems
+}
+
+// Steps returns the still capture steps, parsing the legacy StillCommand,
+// where steps are separated by ";" and arguments by spaces, if no steps are
+// configured.
+func (c *CameraConfig) Steps() []CommandStep {
+	if len(c.StillSteps) > 0 || c.StillCommand == "" {
+		return c.StillSteps
+	}
+
+	steps := make([]CommandStep, 0)
+	for _, cmd := range strings.Split(c.StillCommand, ";") {
+		argv := strings.Fields(cmd)
+		if len(argv) == 0 {
+			continue
+		}
+		steps = append(steps, CommandStep{Argv: argv})
+	}
+
+	return steps
+}
+
+// TemplateVariable matches a {name} placeholder in still capture steps and
+// the still output path, both when validating and when expanding them.
+var TemplateVariable = regexp.MustCompile(`\{(\w+)\}`)
+
+// unknownVariable returns the first template variable in s that is not one
+// of StillVariables.
+func unknownVariable(s string) (string, bool) {
+	for _, match := range TemplateVariable.FindAllStringSubmatch(s, -1) {
+		known := false
+		for _, v := range StillVariables {
+			if match[1] == v {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return match[1], true
+		}
+	}
+
+	return "", false
+}
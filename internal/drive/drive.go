@@ -1,12 +1,9 @@
 package drive
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-
-	"github.com/dstuessy/film-scanner/internal/auth"
-	"github.com/dstuessy/film-scanner/internal/camera"
+	"io"
 
 	"golang.org/x/oauth2"
 	gdrive "google.golang.org/api/drive/v3"
@@ -21,8 +18,8 @@ func GetContext() context.Context {
 	return context.Background()
 }
 
-func GetDriveFileService(token *oauth2.Token, ctx context.Context) (*gdrive.Service, error) {
-	return gdrive.NewService(ctx, option.WithTokenSource(auth.OauthConf.TokenSource(ctx, token)))
+func GetDriveFileService(oauth *oauth2.Config, token *oauth2.Token, ctx context.Context) (*gdrive.Service, error) {
+	return gdrive.NewService(ctx, option.WithTokenSource(oauth.TokenSource(ctx, token)))
 }
 
 func CreateFolder(srv *gdrive.Service, name string, parentId string) (*gdrive.File, error) {
@@ -93,14 +90,12 @@ func GetWorkspaceDir(srv *gdrive.Service) (*gdrive.File, error) {
 }
 
 func ListFiles(srv *gdrive.Service, parentId string, page string) (*gdrive.FileList, error) {
-	q := "(mimeType='image/jpeg' or mimeType='image/tiff' or mimeType='application/vnd.google-apps.folder') and trashed=false"
+	q := "(mimeType='image/jpeg' or mimeType='image/tiff' or mimeType='image/png' or mimeType='image/webp' or mimeType='application/vnd.google-apps.folder') and trashed=false"
 
 	if parentId != "" {
 		q = fmt.Sprintf("%s and '%s' in parents", q, parentId)
 	}
 
-	fmt.Println(q)
-
 	files, err := srv.Files.List().
 		PageToken(page).
 		PageSize(PageSize).
@@ -116,17 +111,18 @@ func ListFiles(srv *gdrive.Service, parentId string, page string) (*gdrive.FileL
 	return files, nil
 }
 
-func SaveImage(srv *gdrive.Service, img []byte, name string, parentId string) (*gdrive.File, error) {
+// SaveImage uploads an image of the given MIME type as it is read from img.
+func SaveImage(srv *gdrive.Service, img io.Reader, name string, mimeType string, parentId string) (*gdrive.File, error) {
 	f := &gdrive.File{
 		Name:     name,
-		MimeType: camera.GetMimeType(),
+		MimeType: mimeType,
 	}
 
 	if parentId != "" {
 		f.Parents = []string{parentId}
 	}
 
-	r, err := srv.Files.Create(f).Media(bytes.NewReader(img)).Do()
+	r, err := srv.Files.Create(f).Media(img).Do()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,112 @@
+package icc
+
+import (
+	"math"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+// FromSRGB converts sRGB image data, as captured and processed, into the
+// working space of the profile. Greyscale data only has its tone curve
+// converted, to match the grey profile of the space. Data for profiles that
+// cannot be converted into is returned unchanged.
+func (p Profile) FromSRGB(img camera.ImageData) camera.ImageData {
+	channels := img.NumChannels()
+	if !p.CanConvert() || p.IsSRGB() || (channels != 1 && channels != 3) {
+		return img
+	}
+
+	srgb := spaces["srgb"]
+	m := multiply(invert(p.space.colorants), srgb.colorants)
+
+	levels := 1 << img.BitDepth()
+	max := float64(levels - 1)
+	linear := make([]float64, levels)
+	for i := range linear {
+		linear[i] = srgb.linear(float64(i) / max)
+	}
+
+	// the inverse curve is sampled finely enough for 16-bit output
+	steps := 1 << 16
+	encoded := make([]float64, steps+1)
+	for i := range encoded {
+		encoded[i] = p.space.encoded(float64(i)/float64(steps)) * max
+	}
+
+	sample := func(i int) int {
+		if levels == 256 {
+			return int(img.Data[i])
+		}
+		return int(img.Data[2*i]) | int(img.Data[2*i+1])<<8
+	}
+
+	out := camera.ImageData{
+		Rows:     img.Rows,
+		Cols:     img.Cols,
+		Data:     make([]byte, len(img.Data)),
+		Depth:    img.Depth,
+		Channels: img.Channels,
+	}
+
+	put := func(i int, v float64) {
+		v = math.Max(0, math.Min(1, v))
+		q := int(math.Round(encoded[int(math.Round(v*float64(steps)))]))
+		if levels == 256 {
+			out.Data[i] = byte(q)
+		} else {
+			out.Data[2*i], out.Data[2*i+1] = byte(q), byte(q>>8)
+		}
+	}
+
+	if channels == 1 {
+		for px := 0; px < img.Rows*img.Cols; px++ {
+			put(px, linear[sample(px)])
+		}
+		return out
+	}
+
+	for px := 0; px < img.Rows*img.Cols; px++ {
+		r, g, b := linear[sample(3*px)], linear[sample(3*px+1)], linear[sample(3*px+2)]
+		for c := 0; c < 3; c++ {
+			put(3*px+c, m[c][0]*r+m[c][1]*g+m[c][2]*b)
+		}
+	}
+
+	return out
+}
+
+func multiply(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invert(a [3][3]float64) [3][3]float64 {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+
+	return [3][3]float64{
+		{
+			(a[1][1]*a[2][2] - a[1][2]*a[2][1]) / det,
+			(a[0][2]*a[2][1] - a[0][1]*a[2][2]) / det,
+			(a[0][1]*a[1][2] - a[0][2]*a[1][1]) / det,
+		},
+		{
+			(a[1][2]*a[2][0] - a[1][0]*a[2][2]) / det,
+			(a[0][0]*a[2][2] - a[0][2]*a[2][0]) / det,
+			(a[0][2]*a[1][0] - a[0][0]*a[1][2]) / det,
+		},
+		{
+			(a[1][0]*a[2][1] - a[1][1]*a[2][0]) / det,
+			(a[0][1]*a[2][0] - a[0][0]*a[2][1]) / det,
+			(a[0][0]*a[1][1] - a[0][1]*a[1][0]) / det,
+		},
+	}
+}
@@ -0,0 +1,269 @@
+package icc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Profile is an ICC colour profile to embed in scans. Built in working
+// spaces also carry what is needed to convert sRGB image data into them,
+// and a matching greyscale profile.
+type Profile struct {
+	Name  string
+	Data  []byte
+	Grey  []byte // greyscale profile with the same tone curve, nil if unknown
+	space *space // nil for profiles image data cannot be converted into
+}
+
+// space is an RGB working space given by its D50 adapted colorants, as the
+// profile connection space uses D50.
+type space struct {
+	name      string
+	colorants [3][3]float64 // columns are the XYZ of red, green and blue
+	white     [3]float64    // media white point
+	gamma     float64       // 0 for the sRGB tone curve
+}
+
+var d50 = [3]float64{0.9642, 1.0, 0.8249}
+var d65 = [3]float64{0.9505, 1.0, 1.0890}
+
+var spaces = map[string]space{
+	"srgb": {
+		name: "sRGB IEC61966-2.1",
+		colorants: [3][3]float64{
+			{0.4360747, 0.3850649, 0.1430804},
+			{0.2225045, 0.7168786, 0.0606169},
+			{0.0139322, 0.0971045, 0.7141733},
+		},
+		white: d65,
+	},
+	"adobergb": {
+		name: "Adobe RGB (1998) compatible",
+		colorants: [3][3]float64{
+			{0.6097559, 0.2052401, 0.1492240},
+			{0.3111242, 0.6256560, 0.0632197},
+			{0.0194811, 0.0608902, 0.7448387},
+		},
+		white: d65,
+		gamma: 563.0 / 256.0,
+	},
+	"prophoto": {
+		name: "ProPhoto RGB (ROMM) compatible",
+		colorants: [3][3]float64{
+			{0.7976749, 0.1351917, 0.0313534},
+			{0.2880402, 0.7118741, 0.0000857},
+			{0.0000000, 0.0000000, 0.8252100},
+		},
+		white: d50,
+		gamma: 1.8,
+	},
+}
+
+// Builtin returns one of the working spaces "srgb", "adobergb" or
+// "prophoto".
+func Builtin(name string) (Profile, error) {
+	s, ok := spaces[name]
+	if !ok {
+		return Profile{}, errors.New(fmt.Sprintf("Unknown colour profile %q", name))
+	}
+
+	return Profile{
+		Name:  s.name,
+		Data:  s.rgbProfile(),
+		Grey:  s.greyProfile(),
+		space: &s,
+	}, nil
+}
+
+// Load reads a user supplied profile, such as one made for the camera. Its
+// image data is embedded as captured, without conversion.
+func Load(path string) (Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if len(data) < 128 || !bytes.Equal(data[36:40], []byte("acsp")) {
+		return Profile{}, errors.New(fmt.Sprintf("%s is not an ICC profile", path))
+	}
+
+	p := Profile{Name: path}
+	switch string(data[16:20]) {
+	case "RGB ":
+		p.Data = data
+	case "GRAY":
+		p.Grey = data
+	default:
+		return Profile{}, errors.New(fmt.Sprintf("%s is neither an RGB nor a greyscale profile", path))
+	}
+
+	return p, nil
+}
+
+// ForChannels returns the profile matching image data of 1 or 3 channels,
+// or nil if there is none.
+func (p Profile) ForChannels(channels int) []byte {
+	if channels == 1 {
+		return p.Grey
+	}
+	return p.Data
+}
+
+// IsSRGB reports whether sRGB data needs no conversion for the profile.
+func (p Profile) IsSRGB() bool {
+	return p.space != nil && p.space.gamma == 0
+}
+
+// CanConvert reports whether sRGB data can be converted into the profile.
+func (p Profile) CanConvert() bool {
+	return p.space != nil
+}
+
+func s15Fixed16(v float64) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+	return b
+}
+
+func xyzTag(x, y, z float64) []byte {
+	b := append([]byte("XYZ "), 0, 0, 0, 0)
+	b = append(b, s15Fixed16(x)...)
+	b = append(b, s15Fixed16(y)...)
+	return append(b, s15Fixed16(z)...)
+}
+
+// descTag is a v2 textDescriptionType with empty Unicode and ScriptCode
+// parts.
+func descTag(text string) []byte {
+	b := append([]byte("desc"), 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(text)+1))
+	b = append(b, text...)
+	b = append(b, 0)
+	b = append(b, make([]byte, 4+4+2+1+67)...)
+	return b
+}
+
+func textTag(text string) []byte {
+	b := append([]byte("text"), 0, 0, 0, 0)
+	b = append(b, text...)
+	return append(b, 0)
+}
+
+// curveTag is a single gamma value, or a table of the sRGB curve.
+func (s space) curveTag() []byte {
+	b := append([]byte("curv"), 0, 0, 0, 0)
+
+	if s.gamma > 0 {
+		b = binary.BigEndian.AppendUint32(b, 1)
+		return binary.BigEndian.AppendUint16(b, uint16(math.Round(s.gamma*256)))
+	}
+
+	n := 1024
+	b = binary.BigEndian.AppendUint32(b, uint32(n))
+	for i := 0; i < n; i++ {
+		v := s.linear(float64(i) / float64(n-1))
+		b = binary.BigEndian.AppendUint16(b, uint16(math.Round(v*65535)))
+	}
+	return b
+}
+
+// linear applies the tone curve of the space, turning an encoded value into
+// a linear one.
+func (s space) linear(v float64) float64 {
+	if s.gamma > 0 {
+		return math.Pow(v, s.gamma)
+	}
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// encoded is the inverse of linear.
+func (s space) encoded(v float64) float64 {
+	if s.gamma > 0 {
+		return math.Pow(v, 1/s.gamma)
+	}
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+type tag struct {
+	sig  string
+	data []byte
+}
+
+func (s space) rgbProfile() []byte {
+	curve := s.curveTag()
+	c := s.colorants
+
+	return encodeProfile("RGB ", []tag{
+		{"desc", descTag(s.name)},
+		{"cprt", textTag("No copyright, use freely")},
+		{"wtpt", xyzTag(s.white[0], s.white[1], s.white[2])},
+		{"rXYZ", xyzTag(c[0][0], c[1][0], c[2][0])},
+		{"gXYZ", xyzTag(c[0][1], c[1][1], c[2][1])},
+		{"bXYZ", xyzTag(c[0][2], c[1][2], c[2][2])},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	})
+}
+
+func (s space) greyProfile() []byte {
+	return encodeProfile("GRAY", []tag{
+		{"desc", descTag(fmt.Sprintf("%s grey", s.name))},
+		{"cprt", textTag("No copyright, use freely")},
+		{"wtpt", xyzTag(s.white[0], s.white[1], s.white[2])},
+		{"kTRC", s.curveTag()},
+	})
+}
+
+// encodeProfile writes a v2.1 display profile. Tags with identical data,
+// such as the three tone curves, share one copy.
+func encodeProfile(colourSpace string, tags []tag) []byte {
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:12], 0x02100000)
+	copy(header[12:16], "mntr")
+	copy(header[16:20], colourSpace)
+	copy(header[20:24], "XYZ ")
+	// creation date, fixed so that profiles are reproducible
+	for i, v := range []uint16{2024, 1, 1, 0, 0, 0} {
+		binary.BigEndian.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:40], "acsp")
+	copy(header[68:80], append(append(s15Fixed16(d50[0]), s15Fixed16(d50[1])...), s15Fixed16(d50[2])...))
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	data := make([]byte, 0)
+	offset := 128 + 4 + 12*len(tags)
+	placed := make(map[string]int)
+
+	for _, t := range tags {
+		o, ok := placed[string(t.data)]
+		if !ok {
+			o = offset + len(data)
+			placed[string(t.data)] = o
+			data = append(data, t.data...)
+			// tags start on 4 byte boundaries
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(o))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile[0:4], uint32(len(profile)))
+
+	return profile
+}
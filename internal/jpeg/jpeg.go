@@ -0,0 +1,192 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	markerSOI  = 0xD8
+	markerAPP0 = 0xE0
+	markerAPP1 = 0xE1
+	markerAPP2 = 0xE2
+	markerAPPF = 0xEF
+	markerCOM  = 0xFE
+
+	// maxSegment is the largest payload of a segment, whose length field
+	// counts itself
+	maxSegment = 0xFFFF - 2
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// Segment is an application segment of a JPEG.
+type Segment struct {
+	Marker byte
+	Data   []byte // payload including the identifying header
+}
+
+func (s Segment) encode() []byte {
+	n := len(s.Data) + 2
+	return append([]byte{0xFF, s.Marker, byte(n >> 8), byte(n)}, s.Data...)
+}
+
+func ExifSegment(exif []byte) Segment {
+	return Segment{Marker: markerAPP1, Data: append(append([]byte(nil), exifHeader...), exif...)}
+}
+
+func XMPSegment(xmp []byte) Segment {
+	return Segment{Marker: markerAPP1, Data: append(append([]byte(nil), xmpHeader...), xmp...)}
+}
+
+// ICCSegments splits an ICC profile over as many APP2 segments as it
+// needs, each numbered along with the total.
+func ICCSegments(profile []byte) ([]Segment, error) {
+	chunk := maxSegment - len(iccHeader) - 2
+	n := (len(profile) + chunk - 1) / chunk
+	if n > 255 {
+		return nil, errors.New(fmt.Sprintf("ICC profile of %d bytes is too large for a JPEG", len(profile)))
+	}
+
+	segments := make([]Segment, 0, n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * chunk
+		if end > len(profile) {
+			end = len(profile)
+		}
+
+		data := append(append([]byte(nil), iccHeader...), byte(i+1), byte(n))
+		segments = append(segments, Segment{Marker: markerAPP2, Data: append(data, profile[i*chunk:end]...)})
+	}
+
+	return segments, nil
+}
+
+func isICC(s Segment) bool {
+	return s.Marker == markerAPP2 && bytes.HasPrefix(s.Data, iccHeader)
+}
+
+func isExif(s Segment) bool {
+	return s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, exifHeader)
+}
+
+// IsJpeg reports whether buf starts with a JPEG SOI marker.
+func IsJpeg(buf []byte) bool {
+	return len(buf) >= 2 && buf[0] == 0xFF && buf[1] == markerSOI
+}
+
+// Segments lists the application and comment segments at the start of a
+// JPEG, up to the first other marker.
+func Segments(buf []byte) ([]Segment, int, error) {
+	if !IsJpeg(buf) {
+		return nil, 0, errors.New("Not a JPEG, missing SOI marker")
+	}
+
+	segments := make([]Segment, 0)
+	i := 2
+	for i+4 <= len(buf) && buf[i] == 0xFF {
+		marker := buf[i+1]
+		if (marker < markerAPP0 || marker > markerAPPF) && marker != markerCOM {
+			break
+		}
+
+		n := int(buf[i+2])<<8 | int(buf[i+3])
+		if n < 2 || i+2+n > len(buf) {
+			return nil, 0, errors.New("JPEG segment runs past the end of the file")
+		}
+
+		segments = append(segments, Segment{Marker: marker, Data: buf[i+4 : i+2+n]})
+		i += 2 + n
+	}
+
+	return segments, i, nil
+}
+
+// Embed rewrites the leading segments of a JPEG. Segments for which replace
+// returns true are dropped, and the new segments are placed after a leading
+// JFIF APP0 and Exif APP1 segment, which readers expect first.
+func Embed(buf []byte, segments []Segment, replace func(Segment) bool) ([]byte, error) {
+	existing, end, err := Segments(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range segments {
+		if len(s.Data) > maxSegment {
+			return nil, errors.New(fmt.Sprintf("JPEG segment of %d bytes is too large", len(s.Data)))
+		}
+	}
+
+	out := make([]byte, 0, len(buf)+len(segments)*1024)
+	out = append(out, 0xFF, markerSOI)
+
+	kept := existing
+	for len(kept) > 0 && (kept[0].Marker == markerAPP0 || isExif(kept[0])) {
+		if replace == nil || !replace(kept[0]) {
+			out = append(out, kept[0].encode()...)
+		}
+		kept = kept[1:]
+	}
+
+	for _, s := range segments {
+		out = append(out, s.encode()...)
+	}
+
+	for _, s := range kept {
+		if replace == nil || !replace(s) {
+			out = append(out, s.encode()...)
+		}
+	}
+
+	return append(out, buf[end:]...), nil
+}
+
+// Exif returns the TIFF structure of the Exif segment a JPEG has, or nil if
+// it has none.
+func Exif(buf []byte) []byte {
+	existing, _, err := Segments(buf)
+	if err != nil {
+		return nil
+	}
+
+	for _, s := range existing {
+		if isExif(s) {
+			return s.Data[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+// EmbedMetadata adds Exif and XMP segments to a JPEG, replacing those it
+// already has. To keep what a camera wrote, merge it into exif, see Exif.
+func EmbedMetadata(buf []byte, exif, xmp []byte) ([]byte, error) {
+	segments := make([]Segment, 0)
+	if len(exif) > 0 {
+		segments = append(segments, ExifSegment(exif))
+	}
+	if len(xmp) > 0 {
+		segments = append(segments, XMPSegment(xmp))
+	}
+
+	return Embed(buf, segments, func(s Segment) bool {
+		if len(exif) > 0 && isExif(s) {
+			return true
+		}
+		return len(xmp) > 0 && s.Marker == markerAPP1 && bytes.HasPrefix(s.Data, xmpHeader)
+	})
+}
+
+// EmbedICC adds an ICC profile to a JPEG, replacing any it already has.
+func EmbedICC(buf []byte, profile []byte) ([]byte, error) {
+	segments, err := ICCSegments(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return Embed(buf, segments, isICC)
+}
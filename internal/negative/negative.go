@@ -0,0 +1,320 @@
+package negative
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+type FilmType string
+
+const (
+	Positive      FilmType = "positive"
+	ColorNegative FilmType = "color"
+	BWNegative    FilmType = "bw"
+)
+
+// clipLevel excludes pixels at or above this level from base sampling, as
+// they are most likely the bare light source shining past the film.
+const clipLevel = 250
+
+// rebateMargin is the width of the band sampled around a cropped frame, as
+// a fraction of the frame size.
+const rebateMargin = 0.05
+
+// basePercentile picks the film base from the brightest parts of an uncropped
+// negative when no rebate or base region is available.
+const basePercentile = 0.99
+
+// levelsLow and levelsHigh are the percentiles stretched to black and white
+// after inversion.
+const levelsLow = 0.005
+const levelsHigh = 0.995
+
+// Base is the 8-bit RGB colour of the unexposed film base, which carries the
+// orange mask on colour negatives.
+type Base [3]float64
+
+type histogram [3][256]int
+
+func ParseFilmType(s string) (FilmType, error) {
+	switch FilmType(s) {
+	case Positive, ColorNegative, BWNegative:
+		return FilmType(s), nil
+	case "":
+		return Positive, nil
+	}
+
+	return Positive, errors.New(fmt.Sprintf("Unknown film type %s", s))
+}
+
+func (ft FilmType) IsNegative() bool {
+	return ft == ColorNegative || ft == BWNegative
+}
+
+// SampleBase takes the median colour of an unexposed area of the film, such
+// as a region of the rebate picked by the user.
+func SampleBase(img camera.ImageData, region image.Rectangle) (Base, error) {
+	region = region.Intersect(image.Rect(0, 0, img.Cols, img.Rows))
+
+	h := buildHistogram(img, func(x, y int) bool {
+		return image.Pt(x, y).In(region)
+	})
+
+	return baseFromHistogram(h, 0.5)
+}
+
+// RebateBase takes the median colour of the rebate in a band around the
+// frame, which is where the unexposed film base shows on a negative.
+func RebateBase(img camera.ImageData, frame image.Rectangle) (Base, error) {
+	mx := int(float64(frame.Dx()) * rebateMargin)
+	my := int(float64(frame.Dy()) * rebateMargin)
+	band := image.Rect(frame.Min.X-mx, frame.Min.Y-my, frame.Max.X+mx, frame.Max.Y+my)
+
+	h := buildHistogram(img, func(x, y int) bool {
+		p := image.Pt(x, y)
+		return p.In(band) && !p.In(frame)
+	})
+
+	return baseFromHistogram(h, 0.5)
+}
+
+// EstimateBase guesses the film base from the brightest unclipped pixels of
+// the whole image.
+func EstimateBase(img camera.ImageData) (Base, error) {
+	h := buildHistogram(img, func(x, y int) bool {
+		return true
+	})
+
+	return baseFromHistogram(h, basePercentile)
+}
+
+// Invert converts a negative to a positive. Colour negatives are divided by
+// the film base to remove the orange mask before inverting, and B&W
+// negatives are inverted as greyscale. Each channel is then stretched to the
+// full range. Positives are returned unchanged. 8 and 16-bit RGB are
+// inverted at their own depth.
+func Invert(img camera.ImageData, filmType FilmType, base Base) camera.ImageData {
+	if !filmType.IsNegative() {
+		return img
+	}
+
+	out := camera.ImageData{
+		Rows:     img.Rows,
+		Cols:     img.Cols,
+		Data:     make([]byte, len(img.Data)),
+		Depth:    img.Depth,
+		Channels: img.Channels,
+	}
+
+	// the base is sampled at 8 bits, so it is scaled up for deeper images
+	top := 1<<img.BitDepth() - 1
+	scale := float64(top) / 255
+
+	var luts [3][]float64
+
+	for c := 0; c < 3; c++ {
+		b := base[c] * scale
+		if filmType == BWNegative || b <= 0 {
+			b = float64(top)
+		}
+
+		luts[c] = make([]float64, top+1)
+		for v := range luts[c] {
+			t := float64(v) / b
+			if t > 1 {
+				t = 1
+			}
+			luts[c][v] = 1 - t
+		}
+	}
+
+	n := countSamples(img)
+	for i := 0; i+2 < n; i += 3 {
+		if filmType == BWNegative {
+			l := luma(sample(img, i), sample(img, i+1), sample(img, i+2))
+			for c := 0; c < 3; c++ {
+				setSample(out, i+c, toLevel(luts[c][l], top))
+			}
+			continue
+		}
+
+		for c := 0; c < 3; c++ {
+			setSample(out, i+c, toLevel(luts[c][sample(img, i+c)], top))
+		}
+	}
+
+	stretchLevels(out)
+
+	return out
+}
+
+func luma(r, g, b int) int {
+	return (299*r + 587*g + 114*b) / 1000
+}
+
+// toLevel maps 0..1 to 0..top.
+func toLevel(v float64, top int) int {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return top
+	}
+	return int(v*float64(top) + 0.5)
+}
+
+func countSamples(img camera.ImageData) int {
+	return len(img.Data) / (img.BitDepth() / 8)
+}
+
+// sample reads sample i of 8 or 16-bit image data.
+func sample(img camera.ImageData, i int) int {
+	if img.BitDepth() == 16 {
+		return int(img.Data[2*i]) | int(img.Data[2*i+1])<<8
+	}
+	return int(img.Data[i])
+}
+
+func setSample(img camera.ImageData, i, v int) {
+	if img.BitDepth() == 16 {
+		img.Data[2*i] = byte(v)
+		img.Data[2*i+1] = byte(v >> 8)
+		return
+	}
+	img.Data[i] = byte(v)
+}
+
+// stretchLevels maps the low and high percentiles of each channel to black
+// and white, which also neutralises any cast left over from the mask.
+func stretchLevels(img camera.ImageData) {
+	top := 1<<img.BitDepth() - 1
+	n := countSamples(img)
+
+	for c := 0; c < 3; c++ {
+		h := make([]int, top+1)
+		for i := c; i < n; i += 3 {
+			h[sample(img, i)]++
+		}
+
+		low := percentile(h, levelsLow)
+		high := percentile(h, levelsHigh)
+		if high <= low {
+			continue
+		}
+
+		lut := make([]int, top+1)
+		for v := range lut {
+			lut[v] = toLevel(float64(v-low)/float64(high-low), top)
+		}
+
+		for i := c; i < n; i += 3 {
+			setSample(img, i, lut[sample(img, i)])
+		}
+	}
+}
+
+// buildHistogram counts the unclipped pixels of 8-bit RGB image data for
+// which include returns true.
+func buildHistogram(img camera.ImageData, include func(x, y int) bool) histogram {
+	var h histogram
+
+	for y := 0; y < img.Rows; y++ {
+		for x := 0; x < img.Cols; x++ {
+			i := (y*img.Cols + x) * 3
+			if i+2 >= len(img.Data) {
+				return h
+			}
+
+			r, g, b := img.Data[i], img.Data[i+1], img.Data[i+2]
+
+			if r >= clipLevel || g >= clipLevel || b >= clipLevel {
+				continue
+			}
+			if !include(x, y) {
+				continue
+			}
+
+			h[0][r]++
+			h[1][g]++
+			h[2][b]++
+		}
+	}
+
+	return h
+}
+
+func baseFromHistogram(h histogram, p float64) (Base, error) {
+	total := 0
+	for _, n := range h[0] {
+		total += n
+	}
+
+	if total == 0 {
+		return Base{}, errors.New("No unclipped film base found to sample")
+	}
+
+	return Base{
+		float64(percentile(h[0][:], p)),
+		float64(percentile(h[1][:], p)),
+		float64(percentile(h[2][:], p)),
+	}, nil
+}
+
+func percentile(h []int, p float64) int {
+	total := 0
+	for _, n := range h {
+		total += n
+	}
+
+	target := int(float64(total) * p)
+	count := 0
+	for v, n := range h {
+		count += n
+		if count > target {
+			return v
+		}
+	}
+
+	return len(h) - 1
+}
+
+// Preview cheaply inverts a preview frame for framing and focusing. Without
+// neutralise the frame is simply inverted, leaving the orange mask as a blue
+// cast; with it the frame goes through Invert using a base estimated from
+// the frame itself.
+func Preview(img camera.ImageData, filmType FilmType, neutralise bool) camera.ImageData {
+	if !filmType.IsNegative() {
+		return img
+	}
+
+	if neutralise {
+		base, err := EstimateBase(img)
+		if err != nil {
+			base = Base{}
+		}
+		return Invert(img, filmType, base)
+	}
+
+	out := camera.ImageData{
+		Rows: img.Rows,
+		Cols: img.Cols,
+		Data: make([]byte, len(img.Data)),
+	}
+
+	for i := 0; i+2 < len(img.Data); i += 3 {
+		if filmType == BWNegative {
+			l := byte(255 - luma(int(img.Data[i]), int(img.Data[i+1]), int(img.Data[i+2])))
+			out.Data[i], out.Data[i+1], out.Data[i+2] = l, l, l
+			continue
+		}
+
+		out.Data[i] = 255 - img.Data[i]
+		out.Data[i+1] = 255 - img.Data[i+1]
+		out.Data[i+2] = 255 - img.Data[i+2]
+	}
+
+	return out
+}
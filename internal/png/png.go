@@ -0,0 +1,106 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var signature = []byte("\x89PNG\r\n\x1a\n")
+
+// profileName names embedded profiles, PNG requires a name of 1 to 79
+// characters.
+const profileName = "ICC profile"
+
+// Chunk is a chunk of a PNG.
+type Chunk struct {
+	Type string
+	Data []byte
+}
+
+func (c Chunk) encode() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(c.Data)))
+	buf = append(buf, c.Type...)
+	buf = append(buf, c.Data...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+}
+
+// IsPng reports whether buf starts with the PNG signature.
+func IsPng(buf []byte) bool {
+	return bytes.HasPrefix(buf, signature)
+}
+
+// Chunks lists the chunks of a PNG.
+func Chunks(buf []byte) ([]Chunk, error) {
+	if !IsPng(buf) {
+		return nil, errors.New("Not a PNG, missing signature")
+	}
+
+	chunks := make([]Chunk, 0)
+	i := len(signature)
+	for i < len(buf) {
+		if i+12 > len(buf) {
+			return nil, errors.New("PNG chunk runs past the end of the file")
+		}
+
+		n := int(binary.BigEndian.Uint32(buf[i : i+4]))
+		if n < 0 || n > len(buf)-i-12 {
+			return nil, errors.New("PNG chunk runs past the end of the file")
+		}
+
+		chunks = append(chunks, Chunk{Type: string(buf[i+4 : i+8]), Data: buf[i+8 : i+8+n]})
+		i += 12 + n
+	}
+
+	if len(chunks) == 0 || chunks[0].Type != "IHDR" {
+		return nil, errors.New("PNG does not start with an IHDR chunk")
+	}
+
+	return chunks, nil
+}
+
+// ICCChunk compresses an ICC profile into an iCCP chunk.
+func ICCChunk(profile []byte) (Chunk, error) {
+	var buf bytes.Buffer
+	buf.WriteString(profileName)
+	buf.Write([]byte{0x0, 0x0}) // name terminator, zlib compression
+
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(profile); err != nil {
+		return Chunk{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return Chunk{}, err
+	}
+
+	return Chunk{Type: "iCCP", Data: buf.Bytes()}, nil
+}
+
+// EmbedICC adds an ICC profile to a PNG after its header, replacing any
+// profile or sRGB chunk it already has, as only one may describe it.
+func EmbedICC(buf []byte, profile []byte) ([]byte, error) {
+	chunks, err := Chunks(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	icc, err := ICCChunk(profile)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(buf)+len(icc.Data)+12)
+	out = append(out, signature...)
+	out = append(out, chunks[0].encode()...)
+	out = append(out, icc.encode()...)
+
+	for _, c := range chunks[1:] {
+		if c.Type == "iCCP" || c.Type == "sRGB" {
+			continue
+		}
+		out = append(out, c.encode()...)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,145 @@
+package scan
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+	"github.com/dstuessy/film-scanner/internal/settings"
+)
+
+// Capture takes the stills for one scan with the project settings, one per
+// bracket exposure, each averaged over the configured number of shots, and
+// processes them into the cache under base with the extension of the
+// captured format. It fails with camera.ErrBusy while another scan is being
+// captured.
+func (sc *Scanner) Capture(projectId string, s settings.Settings, base string) error {
+	exposures := s.BracketExposures()
+	if len(exposures) == 0 {
+		exposures = []string{s.Exposure}
+	}
+
+	meta := Meta{}
+	if s.Shots > 1 {
+		meta.Shots = s.Shots
+	}
+
+	// the preview is paused only while the shots are taken, they are decoded,
+	// averaged and processed once the camera is released
+	shots := make([][]camera.Still, 0, len(exposures))
+	err := camera.Capture(func(take camera.StillFunc) error {
+		for _, exposure := range exposures {
+			taken, err := captureShots(take, camera.StillParams{
+				Project:  projectId,
+				Frame:    s.NextFrame,
+				Exposure: exposure,
+				ISO:      s.ISO,
+			}, s)
+			if err != nil {
+				return err
+			}
+			shots = append(shots, taken)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	first := shots[0][0]
+	if camera.IsRaw(first.Ext) && needsProcessing(s, len(shots), base+first.Ext) {
+		return errors.New("RAW stills can only be stored as captured, shoot RAW+JPEG to process them")
+	}
+
+	// the RAW of a RAW+JPEG capture is kept as the original of the scan
+	if first.Original != nil {
+		meta.Original = OriginalName(base + first.Original.Ext)
+		if err := sc.cache.CacheImage(first.Original.Data, meta.Original, projectId); err != nil {
+			return err
+		}
+	}
+
+	stills := make([]camera.Still, 0, len(shots))
+	for _, taken := range shots {
+		still, err := averageShots(taken, s)
+		if err != nil {
+			return err
+		}
+		stills = append(stills, still)
+	}
+
+	name := base + stills[0].Ext
+
+	if len(stills) > 1 {
+		data := make([][]byte, len(stills))
+		for i, still := range stills {
+			data[i] = still.Data
+		}
+		return sc.processBrackets(projectId, data, name, meta)
+	}
+
+	return sc.process(projectId, stills[0].Data, name, meta)
+}
+
+// needsProcessing reports whether a still captured as name is decoded
+// before it is stored, rather than stored as captured.
+func needsProcessing(s settings.Settings, exposures int, name string) bool {
+	return s.Shots > 1 || exposures > 1 || s.AutoCrop || s.FilmType.IsNegative() || s.OutputName(name) != name
+}
+
+// captureShots takes a still as many times as the project asks.
+func captureShots(take camera.StillFunc, params camera.StillParams, s settings.Settings) ([]camera.Still, error) {
+	n := s.Shots
+	if n < 1 {
+		n = 1
+	}
+
+	shots := make([]camera.Still, 0, n)
+	for i := 0; i < n; i++ {
+		if n > 1 {
+			log.Println("Capturing shot", i+1, "of", n)
+		}
+
+		still, err := take(params)
+		if err != nil {
+			return nil, err
+		}
+		shots = append(shots, still)
+	}
+
+	return shots, nil
+}
+
+// averageShots averages the shots of one exposure into a still in the
+// output format, or the format of the shots if the project keeps the
+// original. A single shot is returned as captured.
+func averageShots(shots []camera.Still, s settings.Settings) (camera.Still, error) {
+	if len(shots) == 1 {
+		return shots[0], nil
+	}
+
+	imgs := make([]camera.ImageData, 0, len(shots))
+	for _, still := range shots {
+		img, err := decodeStill(still.Data)
+		if err != nil {
+			return camera.Still{}, err
+		}
+		imgs = append(imgs, img)
+	}
+
+	averaged, err := camera.AverageStills(imgs)
+	if err != nil {
+		return camera.Still{}, err
+	}
+
+	// averaged stills are encoded by us, in the output format
+	ext := filepath.Ext(s.OutputName("still" + shots[0].Ext))
+
+	data, err := encodeUntagged(averaged, ext)
+	if err != nil {
+		return camera.Still{}, err
+	}
+
+	return camera.Still{Data: data, Ext: ext}, nil
+}
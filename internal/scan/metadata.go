@@ -0,0 +1,205 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dstuessy/film-scanner/internal/icc"
+	"github.com/dstuessy/film-scanner/internal/jpeg"
+	"github.com/dstuessy/film-scanner/internal/settings"
+	"github.com/dstuessy/film-scanner/internal/tiff"
+)
+
+// Software names the scanner in the metadata of every scan.
+const Software = "Open Scanner"
+
+// filmNamespace holds the XMP properties describing the film.
+const filmNamespace = "https://github.com/dstuessy/film-scanner/ns/film/1.0/"
+
+const dcNamespace = "http://purl.org/dc/elements/1.1/"
+
+// scanMetadata describes the scan of the current frame of a project.
+func (sc *Scanner) scanMetadata(s settings.Settings) tiff.Metadata {
+	return tiff.Metadata{
+		DateTime:    time.Now(),
+		Software:    Software,
+		Make:        sc.camera.Make,
+		Model:       sc.camera.Model,
+		Description: description(s),
+		Artist:      s.Artist,
+		Copyright:   s.Copyright,
+		DPI:         s.DPI,
+		XMP:         filmXMP(s),
+	}
+}
+
+// description reads like "Portra 400, roll 12, frame 5".
+func description(s settings.Settings) string {
+	parts := make([]string, 0)
+	if s.FilmStock != "" {
+		parts = append(parts, s.FilmStock)
+	}
+	if s.Roll != "" {
+		parts = append(parts, fmt.Sprintf("roll %s", s.Roll))
+	}
+	parts = append(parts, fmt.Sprintf("frame %d", s.NextFrame))
+	return strings.Join(parts, ", ")
+}
+
+// filmXMP is an XMP packet with the film stock, roll, frame number and
+// development notes of the scan, along with its description, artist and
+// copyright for readers that only look at XMP.
+func filmXMP(s settings.Settings) []byte {
+	var buf bytes.Buffer
+
+	property := func(name, value string) {
+		if value == "" {
+			return
+		}
+		buf.WriteString(fmt.Sprintf("   <film:%s>", name))
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString(fmt.Sprintf("</film:%s>\n", name))
+	}
+
+	// Dublin Core properties are lists, with alternatives by language
+	list := func(name, kind, value string) {
+		if value == "" {
+			return
+		}
+		lang := ""
+		if kind == "Alt" {
+			lang = " xml:lang=\"x-default\""
+		}
+		buf.WriteString(fmt.Sprintf("   <dc:%s><rdf:%s><rdf:li%s>", name, kind, lang))
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString(fmt.Sprintf("</rdf:li></rdf:%s></dc:%s>\n", kind, name))
+	}
+
+	buf.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buf.WriteString(fmt.Sprintf("  <rdf:Description rdf:about=\"\" xmlns:film=\"%s\" xmlns:dc=\"%s\">\n", filmNamespace, dcNamespace))
+	list("description", "Alt", description(s))
+	list("creator", "Seq", s.Artist)
+	list("rights", "Alt", s.Copyright)
+	property("Stock", s.FilmStock)
+	property("Type", string(s.FilmType))
+	property("Roll", s.Roll)
+	property("Frame", fmt.Sprint(s.NextFrame))
+	property("Development", s.DevelopmentNotes)
+	buf.WriteString("  </rdf:Description>\n")
+	buf.WriteString(" </rdf:RDF>\n")
+	buf.WriteString("</x:xmpmeta>\n")
+	buf.WriteString("<?xpacket end=\"w\"?>")
+
+	return buf.Bytes()
+}
+
+// colourProfile is the profile the project's scans are tagged with, if any.
+// A profile that cannot be loaded is logged and the scan left untagged.
+func (sc *Scanner) colourProfile(s settings.Settings) (icc.Profile, bool) {
+	switch s.ColourProfile {
+	case "", "none":
+		return icc.Profile{}, false
+	case "camera":
+		path := sc.camera.Profile
+		if path == "" {
+			log.Println("No camera profile configured, leaving scan untagged")
+			return icc.Profile{}, false
+		}
+
+		p, err := icc.Load(path)
+		if err != nil {
+			log.Println("Failed to load camera profile:", err)
+			return icc.Profile{}, false
+		}
+		return p, true
+	}
+
+	p, err := icc.Builtin(s.ColourProfile)
+	if err != nil {
+		log.Println("Failed to build colour profile:", err)
+		return icc.Profile{}, false
+	}
+	return p, true
+}
+
+// tagStill adds the scan metadata to a still that is stored as captured in
+// the format of ext. JPEGs get Exif, XMP and ICC segments, and .tif or .tiff
+// files our decoder can read are rewritten with the project's encoder
+// options and colour profile. Other stills, such as TIFF-based RAW files,
+// are returned unchanged.
+func (sc *Scanner) tagStill(still []byte, ext string, s settings.Settings) []byte {
+	m := sc.scanMetadata(s)
+	p, ok := sc.colourProfile(s)
+
+	switch {
+	case jpeg.IsJpeg(still):
+		// converting a captured JPEG would mean re-encoding it, so it is
+		// only tagged with profiles describing it as it is
+		var profile []byte
+		if ok && (p.IsSRGB() || !p.CanConvert()) {
+			profile = p.Data
+		} else if ok {
+			log.Println("Leaving captured JPEG untagged, converting it to", p.Name, "would re-encode it")
+		}
+		return tagJpeg(still, m, profile)
+	case isTiffExt(ext) && tiff.IsTiff(still):
+		img, err := tiff.DecodeTiff(still)
+		if err != nil {
+			log.Println("Failed to add metadata to TIFF:", err)
+			return still
+		}
+
+		opts := s.TiffOptions()
+		opts.Metadata = m
+		if ok {
+			img = p.FromSRGB(img)
+			opts.ICC = p.ForChannels(img.NumChannels())
+		}
+		tagged, err := tiff.EncodeTiff(img, opts)
+		if err != nil {
+			log.Println("Failed to add metadata to TIFF:", err)
+			return still
+		}
+		return tagged
+	}
+
+	return still
+}
+
+// tagJpeg embeds metadata and, if given, an ICC profile in a JPEG. Exif the
+// camera wrote is kept, with our fields merged into it. The JPEG is returned
+// unchanged if it cannot be read.
+func tagJpeg(buf []byte, m tiff.Metadata, profile []byte) []byte {
+	exif := tiff.EncodeExif(m)
+	if existing := jpeg.Exif(buf); existing != nil {
+		merged, err := tiff.MergeExif(existing, m)
+		if err != nil {
+			log.Println("Failed to merge metadata into the camera's Exif, keeping it as it is:", err)
+			merged = nil
+		}
+		exif = merged
+	}
+
+	tagged, err := jpeg.EmbedMetadata(buf, exif, m.XMP)
+	if err != nil {
+		log.Println("Failed to add metadata to JPEG:", err)
+		return buf
+	}
+
+	if len(profile) > 0 {
+		withProfile, err := jpeg.EmbedICC(tagged, profile)
+		if err != nil {
+			log.Println("Failed to add colour profile to JPEG:", err)
+			return tagged
+		}
+		tagged = withProfile
+	}
+
+	return tagged
+}
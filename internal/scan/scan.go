@@ -0,0 +1,400 @@
+package scan
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/dstuessy/film-scanner/internal/cache"
+	"github.com/dstuessy/film-scanner/internal/camera"
+	"github.com/dstuessy/film-scanner/internal/config"
+	"github.com/dstuessy/film-scanner/internal/jpeg"
+	"github.com/dstuessy/film-scanner/internal/negative"
+	"github.com/dstuessy/film-scanner/internal/png"
+	"github.com/dstuessy/film-scanner/internal/settings"
+	"github.com/dstuessy/film-scanner/internal/tiff"
+	"github.com/dstuessy/film-scanner/internal/webp"
+)
+
+// Meta records how a cached scan was processed after capture.
+type Meta struct {
+	Original   string
+	Cropped    bool
+	CropFailed bool
+	CropRect   image.Rectangle
+	CropAngle  float64
+	FilmType   negative.FilmType
+	FilmBase   negative.Base
+	Brackets   []string
+	// BracketPages counts the brackets kept as pages of the one file in
+	// Brackets
+	BracketPages int
+	Shots        int
+}
+
+type CachedScan struct {
+	Name string
+	Meta Meta
+}
+
+// Scanner processes the stills of a project into the cache, with the
+// project's settings and the camera's metadata and profile.
+type Scanner struct {
+	cache    *cache.Cache
+	settings *settings.Store
+	camera   config.CameraConfig
+}
+
+func NewScanner(c *cache.Cache, store *settings.Store, conf config.CameraConfig) *Scanner {
+	return &Scanner{cache: c, settings: store, camera: conf}
+}
+
+// processBrackets merges the stills of a bracketed capture into one scan,
+// keeping the brackets in the cache if the project asks for it, and then
+// processes the merged still like a single capture. Brackets of TIFF scans
+// may be kept as the pages of one file rather than a file each.
+func (sc *Scanner) processBrackets(projectId string, stills [][]byte, name string, meta Meta) error {
+	s, err := sc.settings.Read(projectId)
+	if err != nil {
+		return err
+	}
+
+	out := s.OutputName(name)
+	asPages := s.KeepBrackets && s.BracketPages && isTiffExt(filepath.Ext(out))
+	if s.KeepBrackets && s.BracketPages && !asPages {
+		log.Println("Brackets can only be kept as pages of a TIFF, keeping a file each")
+	}
+
+	brackets := make([]camera.ImageData, 0, len(stills))
+	for i, still := range stills {
+		img, err := decodeStill(still)
+		if err != nil {
+			return err
+		}
+		brackets = append(brackets, img)
+
+		if s.KeepBrackets && !asPages {
+			bracketName := BracketName(name, i+1)
+			if err := sc.cache.CacheImage(still, bracketName, projectId); err != nil {
+				return err
+			}
+			meta.Brackets = append(meta.Brackets, bracketName)
+		}
+	}
+
+	if asPages {
+		bracketsName := BracketsName(out)
+		if err := sc.cacheTiff(brackets, bracketsName, projectId, s); err != nil {
+			return err
+		}
+		meta.Brackets = []string{bracketsName}
+		meta.BracketPages = len(brackets)
+	}
+
+	merged, err := camera.MergeBrackets(brackets)
+	if err != nil {
+		return err
+	}
+
+	still, err := encodeUntagged(merged, filepath.Ext(out))
+	if err != nil {
+		return err
+	}
+
+	return sc.process(projectId, still, out, meta)
+}
+
+// process runs the post-capture stages configured for the project on a
+// still, in the format of name, and stores the result in the cache under
+// name with the extension of the project's output format.
+func (sc *Scanner) process(projectId string, still []byte, name string, meta Meta) error {
+	s, err := sc.settings.Read(projectId)
+	if err != nil {
+		return err
+	}
+
+	meta.FilmType = s.FilmType
+
+	if !s.AutoCrop && !s.FilmType.IsNegative() {
+		return sc.cacheUnprocessed(projectId, still, name, meta, s)
+	}
+
+	img, err := decodeStill(still)
+	if err != nil {
+		return err
+	}
+
+	frame := img
+	var crop camera.Crop
+
+	if s.AutoCrop {
+		cropped, c, err := camera.CropData(img, s.MinCropRatio, s.MaxCropRatio, s.Trim(), s.Deskew)
+		if err != nil {
+			log.Println("Auto crop failed, keeping uncropped frame:", err)
+			meta.CropFailed = true
+		} else {
+			meta.Cropped = true
+			meta.CropRect = c.Rect
+			meta.CropAngle = c.Angle
+			frame = cropped
+			crop = c
+		}
+	}
+
+	if s.FilmType.IsNegative() {
+		base, err := filmBase(img, s, meta.Cropped, crop)
+		if err != nil {
+			return err
+		}
+
+		meta.FilmBase = base
+		frame = negative.Invert(frame, s.FilmType, base)
+		if s.FilmType == negative.BWNegative {
+			frame = camera.GreyData(frame)
+		}
+	}
+
+	if !meta.Cropped && !s.FilmType.IsNegative() {
+		return sc.cacheUnprocessed(projectId, still, name, meta, s)
+	}
+
+	out := s.OutputName(name)
+	if err := sc.cacheStill(frame, out, projectId, s); err != nil {
+		return err
+	}
+
+	// a RAW original of the capture takes the place of the still
+	if s.KeepOriginal && meta.Original == "" {
+		meta.Original = OriginalName(name)
+		if err := sc.cache.CacheImage(still, meta.Original, projectId); err != nil {
+			return err
+		}
+	}
+
+	return sc.cache.CacheMeta(meta, out, projectId)
+}
+
+// cacheUnprocessed stores a still that needed no processing, tagged with the
+// scan metadata, converting it if the project stores scans in another format.
+func (sc *Scanner) cacheUnprocessed(projectId string, still []byte, name string, meta Meta, s settings.Settings) error {
+	out := s.OutputName(name)
+
+	if out == name {
+		if err := sc.cache.CacheImage(sc.tagStill(still, filepath.Ext(name), s), out, projectId); err != nil {
+			return err
+		}
+	} else {
+		img, err := decodeNative(still)
+		if err != nil {
+			return err
+		}
+		if err := sc.cacheStill(img, out, projectId, s); err != nil {
+			return err
+		}
+	}
+
+	return sc.cache.CacheMeta(meta, out, projectId)
+}
+
+// filmBase samples the film base from the configured base region, falling
+// back to the rebate around a cropped frame and then to an estimate from
+// the whole still. The rebate band is taken from the still before it was
+// deskewed, which is close enough for the small angles involved. The base is
+// sampled at 8 bits.
+func filmBase(img camera.ImageData, s settings.Settings, cropped bool, crop camera.Crop) (negative.Base, error) {
+	img = camera.Data8Bit(img)
+
+	if s.HasBaseRegion() {
+		region := image.Rect(
+			int(s.BaseX*float64(img.Cols)),
+			int(s.BaseY*float64(img.Rows)),
+			int((s.BaseX+s.BaseWidth)*float64(img.Cols)),
+			int((s.BaseY+s.BaseHeight)*float64(img.Rows)),
+		)
+		return negative.SampleBase(img, region)
+	}
+
+	if cropped {
+		base, err := negative.RebateBase(img, crop.Frame)
+		if err == nil {
+			return base, nil
+		}
+		log.Println("Failed to sample rebate, estimating film base:", err)
+	}
+
+	return negative.EstimateBase(img)
+}
+
+// decodeStill decodes a still to the RGB the processing stages work on,
+// keeping 16-bit samples. TIFFs, such as those from libcamera-still, are read
+// by our own decoder, with OpenCV as a fallback for layouts it does not
+// support.
+func decodeStill(still []byte) (camera.ImageData, error) {
+	if !tiff.IsTiff(still) {
+		return camera.DecodeImage(still)
+	}
+
+	img, err := tiff.DecodeTiff(still)
+	if err != nil {
+		log.Println("Failed to decode TIFF, trying OpenCV:", err)
+		return camera.DecodeImage(still)
+	}
+
+	return camera.RGBData(img), nil
+}
+
+// decodeNative decodes a still for converting it into another format. TIFFs
+// our decoder can read keep their bit depth and channels.
+func decodeNative(still []byte) (camera.ImageData, error) {
+	if tiff.IsTiff(still) {
+		img, err := tiff.DecodeTiff(still)
+		if err == nil {
+			return img, nil
+		}
+		log.Println("Failed to decode TIFF, trying OpenCV:", err)
+	}
+
+	return camera.DecodeImage(still)
+}
+
+// encodeUntagged encodes a still that is processed further, such as merged
+// brackets, without the metadata and colour conversion of finished scans.
+func encodeUntagged(img camera.ImageData, ext string) ([]byte, error) {
+	if isTiffExt(ext) {
+		return tiff.EncodeTiff(img, tiff.Options{})
+	}
+	return camera.EncodeImage(img, ext)
+}
+
+// encodeStill encodes a scan in the format of ext, other than TIFF, along
+// with its metadata, converting it into the project's colour profile. Only
+// JPEG, PNG and WebP carry a profile, scans in other formats stay in sRGB.
+func (sc *Scanner) encodeStill(img camera.ImageData, ext string, s settings.Settings) ([]byte, error) {
+	p, ok := sc.colourProfile(s)
+	if ok && !carriesProfile(ext) {
+		log.Println("Leaving", ext, "scan in sRGB, the format cannot carry a colour profile")
+		ok = false
+	}
+	if ok {
+		img = p.FromSRGB(img)
+	}
+
+	buf, err := camera.EncodeImageWithOptions(img, ext, s.EncodeOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case jpeg.IsJpeg(buf):
+		return tagJpeg(buf, sc.scanMetadata(s), p.ForChannels(img.NumChannels())), nil
+	case !ok:
+		return buf, nil
+	case png.IsPng(buf):
+		return png.EmbedICC(buf, p.ForChannels(img.NumChannels()))
+	case webp.IsWebp(buf):
+		// WebP is always stored as RGB
+		return webp.EmbedICC(buf, p.ForChannels(3))
+	}
+
+	return buf, nil
+}
+
+func carriesProfile(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	}
+	return false
+}
+
+// cacheStill encodes a processed scan into the cache. TIFFs are streamed
+// into the cache file as they are encoded.
+func (sc *Scanner) cacheStill(img camera.ImageData, name, projectId string, s settings.Settings) error {
+	if isTiffExt(filepath.Ext(name)) {
+		return sc.cacheTiff([]camera.ImageData{img}, name, projectId, s)
+	}
+
+	buf, err := sc.encodeStill(img, filepath.Ext(name), s)
+	if err != nil {
+		return err
+	}
+
+	return sc.cache.CacheImage(buf, name, projectId)
+}
+
+// cacheTiff streams images into the cache as the pages of one TIFF.
+func (sc *Scanner) cacheTiff(imgs []camera.ImageData, name, projectId string, s settings.Settings) error {
+	img, opts := sc.tiffPages(imgs, s)
+	return sc.cache.StreamImage(name, projectId, func(w io.Writer) error {
+		return tiff.NewEncoder(w, opts).Encode(img)
+	})
+}
+
+// tiffPages converts images into the project's colour profile, returning
+// the first along with the options that write the rest as further pages.
+// TIFFs are written by our own encoder, which keeps 16-bit and greyscale data
+// as they are and compresses them as the project asks.
+func (sc *Scanner) tiffPages(imgs []camera.ImageData, s settings.Settings) (camera.ImageData, tiff.Options) {
+	p, ok := sc.colourProfile(s)
+
+	pages := make([]camera.ImageData, 0, len(imgs))
+	for _, img := range imgs {
+		if ok {
+			img = p.FromSRGB(img)
+		}
+		pages = append(pages, img)
+	}
+
+	opts := s.TiffOptions()
+	opts.Metadata = sc.scanMetadata(s)
+	opts.ICC = p.ForChannels(pages[0].NumChannels())
+	opts.Pages = pages[1:]
+
+	return pages[0], opts
+}
+
+func isTiffExt(ext string) bool {
+	ext = strings.ToLower(ext)
+	return ext == ".tif" || ext == ".tiff"
+}
+
+// OriginalName is the cache name of the unprocessed still kept next to name.
+func OriginalName(name string) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.original%s", strings.TrimSuffix(name, ext), ext)
+}
+
+// BracketName is the cache name of the nth exposure of a bracketed scan.
+func BracketName(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.bracket-%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// BracketsName is the cache name of the TIFF holding the brackets of a scan
+// as pages.
+func BracketsName(name string) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.brackets%s", strings.TrimSuffix(name, ext), ext)
+}
+
+// ReadCache lists the cached scans of a project along with their metadata.
+func (sc *Scanner) ReadCache(projectId string) ([]CachedScan, error) {
+	files, err := sc.cache.ReadProject(projectId)
+	if err != nil {
+		return nil, err
+	}
+
+	scans := make([]CachedScan, 0)
+	for _, f := range files {
+		s := CachedScan{Name: f}
+		if _, err := sc.cache.ReadMeta(projectId, f, &s.Meta); err != nil {
+			return nil, err
+		}
+		scans = append(scans, s)
+	}
+
+	return scans, nil
+}
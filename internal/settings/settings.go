@@ -0,0 +1,297 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+	"github.com/dstuessy/film-scanner/internal/config"
+	"github.com/dstuessy/film-scanner/internal/negative"
+	"github.com/dstuessy/film-scanner/internal/tiff"
+)
+
+var dirPerm os.FileMode = 0755
+var filePerm os.FileMode = 0644
+
+// MaxShots bounds the exposures averaged per still, as every shot is held
+// in memory until they are merged.
+const MaxShots = 16
+
+// ThumbnailSize is the longest edge of the preview embedded in TIFF scans.
+const ThumbnailSize = 512
+
+// ColourProfiles are the ICC profiles a project can tag its scans with.
+// Scans are converted from sRGB into the chosen working space, except for
+// "camera", the profile file configured for the camera, which describes the
+// data as captured.
+var ColourProfiles = []string{"none", "srgb", "adobergb", "prophoto", "camera"}
+
+// OutputFormats are the formats a project can store its scans in.
+// "original" keeps the format the camera writes.
+var OutputFormats = []string{"original", "tiff", "png", "jpeg", "webp"}
+
+// outputExts are the file extensions of the output formats, the first of
+// which is given to scans converted into the format.
+var outputExts = map[string][]string{
+	"tiff": {".tiff", ".tif"},
+	"png":  {".png"},
+	"jpeg": {".jpg", ".jpeg"},
+	"webp": {".webp"},
+}
+
+// Settings holds the per-project options applied to every scan.
+type Settings struct {
+	AutoCrop     bool
+	Deskew       bool
+	KeepOriginal bool
+	MinCropRatio float64
+	MaxCropRatio float64
+	TrimX        float64
+	TrimY        float64
+	FilmType     negative.FilmType
+	BaseX        float64
+	BaseY        float64
+	BaseWidth    float64
+	BaseHeight   float64
+	Exposure     string
+	ISO          string
+	NextFrame    int
+	Brackets     string
+	KeepBrackets bool
+	// BracketPages keeps the brackets as pages of one TIFF
+	BracketPages bool
+	Shots        int
+	Compression  string
+	Thumbnail    bool
+	// ColourProfile is one of ColourProfiles
+	ColourProfile string
+	// OutputFormat is one of OutputFormats
+	OutputFormat    string
+	JpegQuality     int
+	JpegSubsampling string
+	// descriptive metadata written into every scan
+	FilmStock        string
+	Roll             string
+	DevelopmentNotes string
+	Artist           string
+	Copyright        string
+	DPI              float64
+}
+
+func Default() Settings {
+	return Settings{
+		AutoCrop:        false,
+		Deskew:          true,
+		KeepOriginal:    true,
+		MinCropRatio:    0.5,
+		MaxCropRatio:    0.95,
+		TrimX:           0,
+		TrimY:           0,
+		FilmType:        negative.Positive,
+		NextFrame:       1,
+		Shots:           1,
+		Compression:     "none",
+		ColourProfile:   "srgb",
+		OutputFormat:    "original",
+		JpegQuality:     95,
+		JpegSubsampling: "444",
+	}
+}
+
+func (s Settings) Trim() []float64 {
+	return []float64{s.TrimX, s.TrimY}
+}
+
+// BracketExposures lists the exposures of a bracketed capture, given as a
+// comma separated list. It is empty when bracketing is off.
+func (s Settings) BracketExposures() []string {
+	exposures := make([]string, 0)
+	for _, e := range strings.Split(s.Brackets, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			exposures = append(exposures, e)
+		}
+	}
+	return exposures
+}
+
+func (s Settings) Validate() error {
+	if s.MinCropRatio <= 0 || s.MinCropRatio > 1 {
+		return errors.New("Minimum crop ratio must be between 0 and 1")
+	}
+
+	if s.MaxCropRatio <= 0 || s.MaxCropRatio > 1 {
+		return errors.New("Maximum crop ratio must be between 0 and 1")
+	}
+
+	if s.MinCropRatio > s.MaxCropRatio {
+		return errors.New("Minimum crop ratio must not exceed the maximum crop ratio")
+	}
+
+	if s.TrimX < 0 || s.TrimX >= 0.5 || s.TrimY < 0 || s.TrimY >= 0.5 {
+		return errors.New("Trim must be between 0 and 0.5")
+	}
+
+	if _, err := negative.ParseFilmType(string(s.FilmType)); err != nil {
+		return err
+	}
+
+	if s.NextFrame < 0 {
+		return errors.New("Frame number must not be negative")
+	}
+
+	if s.Shots < 1 || s.Shots > MaxShots {
+		return errors.New(fmt.Sprintf("Shots to average must be between 1 and %d", MaxShots))
+	}
+
+	if s.DPI < 0 {
+		return errors.New("DPI must not be negative")
+	}
+
+	if _, err := tiff.ParseCompression(s.Compression); err != nil {
+		return err
+	}
+
+	known := false
+	for _, p := range ColourProfiles {
+		known = known || s.ColourProfile == p
+	}
+	if !known {
+		return errors.New(fmt.Sprintf("Unknown colour profile %q", s.ColourProfile))
+	}
+
+	known = false
+	for _, f := range OutputFormats {
+		known = known || s.OutputFormat == f
+	}
+	if !known {
+		return errors.New(fmt.Sprintf("Unknown output format %q", s.OutputFormat))
+	}
+
+	if s.JpegQuality < 1 || s.JpegQuality > 100 {
+		return errors.New("JPEG quality must be between 1 and 100")
+	}
+
+	if _, ok := camera.JpegSubsamplings[s.JpegSubsampling]; !ok {
+		return errors.New(fmt.Sprintf("Unknown JPEG chroma subsampling %q", s.JpegSubsampling))
+	}
+
+	if len(s.BracketExposures()) == 1 {
+		return errors.New("Bracketing needs at least two exposures")
+	}
+
+	if s.BaseX < 0 || s.BaseY < 0 || s.BaseWidth < 0 || s.BaseHeight < 0 ||
+		s.BaseX+s.BaseWidth > 1 || s.BaseY+s.BaseHeight > 1 {
+		return errors.New("Film base region must lie within the frame")
+	}
+
+	return nil
+}
+
+// TiffOptions are the encoder options for TIFF scans of the project.
+func (s Settings) TiffOptions() tiff.Options {
+	c, err := tiff.ParseCompression(s.Compression)
+	if err != nil {
+		c = tiff.CompressionNone
+	}
+	opts := tiff.Options{Compression: c}
+	if s.Thumbnail {
+		opts.Thumbnail = ThumbnailSize
+	}
+	return opts
+}
+
+// OutputName is the name a still captured as name is stored under, with the
+// extension of the project's output format.
+func (s Settings) OutputName(name string) string {
+	exts, ok := outputExts[s.OutputFormat]
+	if !ok {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	for _, e := range exts {
+		if strings.EqualFold(ext, e) {
+			return name
+		}
+	}
+
+	return strings.TrimSuffix(name, ext) + exts[0]
+}
+
+// EncodeOptions are the encoder options for scans in other formats than
+// TIFF.
+func (s Settings) EncodeOptions() camera.EncodeOptions {
+	return camera.EncodeOptions{
+		JpegQuality:     s.JpegQuality,
+		JpegSubsampling: s.JpegSubsampling,
+	}
+}
+
+// HasBaseRegion reports whether a film base sample region has been set.
+func (s Settings) HasBaseRegion() bool {
+	return s.BaseWidth > 0 && s.BaseHeight > 0
+}
+
+// Store keeps the settings of each project as a JSON file in a directory.
+type Store struct {
+	dir string
+}
+
+// NewStore creates the configured settings directory if it does not exist.
+func NewStore(conf config.SettingsConfig) (*Store, error) {
+	if _, err := os.Stat(conf.Dir); err != nil {
+		err := os.Mkdir(conf.Dir, dirPerm)
+		if err != nil {
+			log.Println("Failed to create settings dir:", conf.Dir)
+			return nil, err
+		}
+		log.Println("Created settings dir:", conf.Dir)
+	}
+
+	return &Store{dir: conf.Dir}, nil
+}
+
+// Read returns the settings saved for a project, or the defaults if none
+// have been saved yet.
+func (st *Store) Read(projectId string) (Settings, error) {
+	s := Default()
+
+	filePath := filepath.Join(st.dir, fmt.Sprintf("%s.json", projectId))
+
+	file, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, errors.New(fmt.Sprintf("Failed to read settings %s", filePath))
+	}
+
+	if err := json.Unmarshal(file, &s); err != nil {
+		return Default(), errors.New(fmt.Sprintf("Failed to parse settings %s", filePath))
+	}
+
+	return s, nil
+}
+
+func (st *Store) Save(projectId string, s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	file, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(st.dir, fmt.Sprintf("%s.json", projectId))
+	if os.WriteFile(filePath, file, filePerm) != nil {
+		return errors.New(fmt.Sprintf("Failed to write settings %s", filePath))
+	}
+
+	return nil
+}
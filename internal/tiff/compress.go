@@ -0,0 +1,218 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression is the value of the TIFF Compression tag.
+type Compression uint16
+
+const (
+	CompressionNone     Compression = 1
+	CompressionLZW      Compression = 5
+	CompressionDeflate  Compression = 8 // Adobe Deflate
+	CompressionPackBits Compression = 32773
+
+	// compressionDeflateOld is the code some older writers use for Deflate
+	compressionDeflateOld Compression = 32946
+)
+
+var compressionNames = map[string]Compression{
+	"none":     CompressionNone,
+	"lzw":      CompressionLZW,
+	"deflate":  CompressionDeflate,
+	"packbits": CompressionPackBits,
+}
+
+// ParseCompression parses a compression name as used in project settings.
+// An empty name means no compression.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionNone, nil
+	}
+
+	c, ok := compressionNames[name]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unknown TIFF compression %q", name))
+	}
+
+	return c, nil
+}
+
+// usesPredictor reports whether strips are horizontally differenced before
+// compression, which helps the dictionary based schemes on photographs.
+func (c Compression) usesPredictor() bool {
+	return c == CompressionLZW || c == CompressionDeflate
+}
+
+// compressStrip compresses the rows of one strip, each rowLen bytes long.
+func compressStrip(strip []byte, rowLen int, c Compression) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return strip, nil
+	case CompressionLZW:
+		return lzwCompress(strip), nil
+	case CompressionDeflate:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(strip); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionPackBits:
+		// rows are packed separately, as the spec requires
+		packed := make([]byte, 0, len(strip))
+		for i := 0; i < len(strip); i += rowLen {
+			packed = packBits(packed, strip[i:i+rowLen])
+		}
+		return packed, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unsupported TIFF compression %d", c))
+}
+
+// decompressStrip expands a strip or tile of size bytes.
+func decompressStrip(data []byte, size int, c Compression) ([]byte, error) {
+	var out []byte
+	var err error
+
+	switch c {
+	case CompressionNone:
+		// copied, as the predictor is undone in place
+		out = append([]byte(nil), data...)
+	case CompressionLZW:
+		out, err = lzwDecompress(data, size)
+	case CompressionDeflate, compressionDeflateOld:
+		var zr io.ReadCloser
+		zr, err = zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		out = make([]byte, size)
+		_, err = io.ReadFull(zr, out)
+	case CompressionPackBits:
+		out, err = unpackBits(data, size)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported TIFF compression %d", c))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) < size {
+		return nil, errors.New(fmt.Sprintf("Strip holds %d bytes, expected %d", len(out), size))
+	}
+
+	return out[:size], nil
+}
+
+// predict applies the horizontal differencing predictor in place, replacing
+// every sample by its difference to the same sample of the previous pixel.
+// 16-bit samples are little-endian.
+func predict(strip []byte, rowLen, channels, bits int) {
+	for row := 0; row < len(strip); row += rowLen {
+		r := strip[row : row+rowLen]
+
+		if bits == 8 {
+			for i := len(r) - 1; i >= channels; i-- {
+				r[i] -= r[i-channels]
+			}
+			continue
+		}
+
+		step := 2 * channels
+		for i := len(r) - 2; i >= step; i -= 2 {
+			v := uint16(r[i]) | uint16(r[i+1])<<8
+			prev := uint16(r[i-step]) | uint16(r[i-step+1])<<8
+			v -= prev
+			r[i], r[i+1] = byte(v), byte(v>>8)
+		}
+	}
+}
+
+// unpredict reverses the horizontal differencing predictor in place.
+func unpredict(strip []byte, rowLen, channels, bits int) {
+	for row := 0; row+rowLen <= len(strip); row += rowLen {
+		r := strip[row : row+rowLen]
+
+		if bits == 8 {
+			for i := channels; i < len(r); i++ {
+				r[i] += r[i-channels]
+			}
+			continue
+		}
+
+		step := 2 * channels
+		for i := step; i+1 < len(r); i += 2 {
+			v := uint16(r[i]) | uint16(r[i+1])<<8
+			prev := uint16(r[i-step]) | uint16(r[i-step+1])<<8
+			v += prev
+			r[i], r[i+1] = byte(v), byte(v>>8)
+		}
+	}
+}
+
+// packBits appends the PackBits encoding of src to dst. Repeated bytes are
+// written as runs and everything else as literals of up to 128 bytes.
+func packBits(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		run := 1
+		for i+run < len(src) && run < 128 && src[i+run] == src[i] {
+			run++
+		}
+		if run > 1 {
+			dst = append(dst, byte(1-run), src[i])
+			i += run
+			continue
+		}
+
+		start := i
+		for i < len(src) && i-start < 128 {
+			if i+1 < len(src) && src[i] == src[i+1] {
+				break
+			}
+			i++
+		}
+		dst = append(dst, byte(i-start-1))
+		dst = append(dst, src[start:i]...)
+	}
+
+	return dst
+}
+
+// unpackBits expands PackBits data until size bytes have been produced.
+func unpackBits(src []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+
+	for i := 0; i < len(src) && len(out) < size; {
+		n := int(int8(src[i]))
+		i++
+
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("PackBits literal runs past the end of the strip")
+			}
+			out = append(out, src[i:i+n+1]...)
+			i += n + 1
+		case n > -128:
+			if i >= len(src) {
+				return nil, errors.New("PackBits run is missing its byte")
+			}
+			for j := 0; j < 1-n; j++ {
+				out = append(out, src[i])
+			}
+			i++
+		}
+	}
+
+	return out, nil
+}
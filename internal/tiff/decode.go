@@ -0,0 +1,396 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+// tag numbers read by the decoder
+const (
+	tagNewSubfileType            = 0xFE
+	tagImageWidth                = 0x100
+	tagImageLength               = 0x101
+	tagBitsPerSample             = 0x102
+	tagCompression               = 0x103
+	tagPhotometricInterpretation = 0x106
+	tagStripOffsets              = 0x111
+	tagSamplesPerPixel           = 0x115
+	tagRowsPerStrip              = 0x116
+	tagStripByteCounts           = 0x117
+	tagPlanarConfiguration       = 0x11C
+	tagPredictor                 = 0x13D
+	tagTileWidth                 = 0x142
+	tagTileLength                = 0x143
+	tagTileOffsets               = 0x144
+	tagTileByteCounts            = 0x145
+)
+
+// typeSizes are the byte sizes of the TIFF field types, indexed by type.
+var typeSizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
+
+// IsTiff reports whether buf starts with a classic or BigTIFF header.
+func IsTiff(buf []byte) bool {
+	for _, magic := range []string{"II\x2a\x00", "MM\x00\x2a", "II\x2b\x00", "MM\x00\x2b"} {
+		if bytes.HasPrefix(buf, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+type decoder struct {
+	buf    []byte
+	order  binary.ByteOrder
+	big    bool
+	fields map[uint16][]uint
+}
+
+// offset reads an offset or count, which are 64-bit in BigTIFF. Values too
+// large for an int are returned as -1, which callers reject.
+func (d *decoder) offset(b []byte) int {
+	if d.big {
+		return toInt(d.order.Uint64(b))
+	}
+	return toInt(uint64(d.order.Uint32(b)))
+}
+
+func toInt(v uint64) int {
+	if v > math.MaxInt {
+		return -1
+	}
+	return int(v)
+}
+
+// maxSamples bounds the samples per pixel of images the decoder reads.
+const maxSamples = 16
+
+// maxExpansion is the most bytes a compressed byte decompresses to, or zero
+// for compressions the decoder cannot read. LZW codes of at least 9 bits
+// stand for at most 4096 bytes, Deflate's limit is 1032 to 1, and a PackBits
+// run turns 2 bytes into 128.
+func maxExpansion(c Compression) int {
+	switch c {
+	case CompressionNone:
+		return 1
+	case CompressionLZW:
+		return 4096
+	case CompressionDeflate, compressionDeflateOld:
+		return 1032
+	case CompressionPackBits:
+		return 64
+	}
+	return 0
+}
+
+// covers reports whether count bytes decompressing to at most expansion
+// times as much can hold rows of cols pixels of size bytes, without
+// overflowing.
+func covers(count, expansion, rows, cols, size int) bool {
+	budget := math.MaxInt
+	if count < math.MaxInt/expansion {
+		budget = count * expansion
+	}
+	return cols <= budget/rows/size
+}
+
+// maxIfds bounds the IFDs followed in search of a full image, guarding
+// against chains that loop.
+const maxIfds = 64
+
+// DecodeTiff reads the first full-resolution image of a classic or BigTIFF
+// in either byte order, skipping thumbnails, laid out in strips or tiles,
+// uncompressed or compressed with LZW, Deflate or PackBits, with 8 or 16-bit
+// RGB or greyscale samples. 16-bit samples are returned little-endian, as
+// ImageData expects.
+func DecodeTiff(buf []byte) (camera.ImageData, error) {
+	d := decoder{buf: buf, fields: make(map[uint16][]uint)}
+
+	if len(buf) < 8 {
+		return camera.ImageData{}, errors.New("TIFF is too short")
+	}
+
+	switch binary.LittleEndian.Uint16(buf[0:2]) {
+	case EndianII:
+		d.order = binary.LittleEndian
+	case EndianMM:
+		d.order = binary.BigEndian
+	default:
+		return camera.ImageData{}, errors.New("Not a TIFF, unknown byte order")
+	}
+
+	ifdOffset := 0
+	switch d.order.Uint16(buf[2:4]) {
+	case identifierClassic:
+		ifdOffset = d.offset(buf[4:8])
+	case identifierBig:
+		d.big = true
+		if len(buf) < 16 || d.order.Uint16(buf[4:6]) != 8 {
+			return camera.ImageData{}, errors.New("Unsupported BigTIFF offset size")
+		}
+		ifdOffset = d.offset(buf[8:16])
+	default:
+		return camera.ImageData{}, errors.New("Not a TIFF, bad identifier")
+	}
+
+	for i := 0; ; i++ {
+		next, err := d.readIfd(ifdOffset)
+		if err != nil {
+			return camera.ImageData{}, err
+		}
+
+		if d.field(tagNewSubfileType, 0)&subfileReduced == 0 {
+			break
+		}
+		// a file of only reduced images, such as the previews of a RAW, is
+		// not decoded as if the preview were the image
+		if next == 0 || i == maxIfds {
+			return camera.ImageData{}, errors.New("TIFF has no full-resolution image")
+		}
+		d.fields = make(map[uint16][]uint)
+		ifdOffset = next
+	}
+
+	return d.decode()
+}
+
+// readIfd reads the numeric fields of an IFD and returns the offset of the
+// next one. Other field types are not needed to decode the image and are
+// skipped.
+func (d *decoder) readIfd(offset int) (int, error) {
+	countSize, entrySize, slot := 2, 12, 4
+	if d.big {
+		countSize, entrySize, slot = 8, 20, 8
+	}
+
+	if offset < 0 || offset+countSize > len(d.buf) {
+		return 0, errors.New("IFD offset is outside of the file")
+	}
+
+	n := 0
+	if d.big {
+		n = d.offset(d.buf[offset : offset+8])
+	} else {
+		n = int(d.order.Uint16(d.buf[offset : offset+2]))
+	}
+	if n < 0 || n > (len(d.buf)-offset-countSize)/entrySize {
+		return 0, errors.New("IFD runs past the end of the file")
+	}
+
+	for i := 0; i < n; i++ {
+		start := offset + countSize + entrySize*i
+		entry := d.buf[start : start+entrySize]
+		tag := d.order.Uint16(entry[0:2])
+		typ := int(d.order.Uint16(entry[2:4]))
+		count := d.offset(entry[4 : 4+slot])
+
+		if typ != 1 && typ != 3 && typ != 4 && typ != 16 {
+			continue
+		}
+
+		// no field holds more values than the file has bytes
+		if count < 0 || count > len(d.buf) {
+			return 0, errors.New(fmt.Sprintf("Field %d has an invalid count", tag))
+		}
+		size := typeSizes[typ] * count
+		data := entry[entrySize-slot:]
+		if size > slot {
+			o := d.offset(data)
+			if o < 0 || size > len(d.buf)-o {
+				return 0, errors.New(fmt.Sprintf("Field %d runs past the end of the file", tag))
+			}
+			data = d.buf[o : o+size]
+		}
+
+		values := make([]uint, count)
+		for j := range values {
+			switch typ {
+			case 1:
+				values[j] = uint(data[j])
+			case 3:
+				values[j] = uint(d.order.Uint16(data[2*j:]))
+			case 4:
+				values[j] = uint(d.order.Uint32(data[4*j:]))
+			case 16:
+				values[j] = uint(d.order.Uint64(data[8*j:]))
+			}
+		}
+		d.fields[tag] = values
+	}
+
+	end := offset + countSize + entrySize*n
+	if end+slot > len(d.buf) {
+		return 0, nil
+	}
+	return d.offset(d.buf[end : end+slot]), nil
+}
+
+// field returns the first value of a field, or def if it is missing.
+func (d *decoder) field(tag uint16, def uint) uint {
+	if v, ok := d.fields[tag]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+func (d *decoder) decode() (camera.ImageData, error) {
+	cols := toInt(uint64(d.field(tagImageWidth, 0)))
+	rows := toInt(uint64(d.field(tagImageLength, 0)))
+	if cols <= 0 || rows <= 0 {
+		return camera.ImageData{}, errors.New("TIFF has no image size")
+	}
+
+	samples := toInt(uint64(d.field(tagSamplesPerPixel, 1)))
+	if samples < 1 || samples > maxSamples {
+		return camera.ImageData{}, errors.New(fmt.Sprintf("Unsupported samples per pixel %d", samples))
+	}
+	bits := int(d.field(tagBitsPerSample, 1))
+	for _, b := range d.fields[tagBitsPerSample] {
+		if int(b) != bits {
+			return camera.ImageData{}, errors.New("Samples of differing bit depth are not supported")
+		}
+	}
+	if bits != 8 && bits != 16 {
+		return camera.ImageData{}, errors.New(fmt.Sprintf("Unsupported bit depth %d", bits))
+	}
+
+	photometric := d.field(tagPhotometricInterpretation, 1)
+	channels := 3
+	switch {
+	case (photometric == 0 || photometric == 1) && samples >= 1:
+		channels = 1
+	case photometric == 2 && samples >= 3:
+	default:
+		return camera.ImageData{}, errors.New(fmt.Sprintf("Unsupported photometric interpretation %d with %d samples", photometric, samples))
+	}
+
+	if d.field(tagPlanarConfiguration, 1) != 1 {
+		return camera.ImageData{}, errors.New("Planar TIFFs are not supported")
+	}
+
+	compression := Compression(d.field(tagCompression, uint(CompressionNone)))
+	expansion := maxExpansion(compression)
+	if expansion == 0 {
+		return camera.ImageData{}, errors.New(fmt.Sprintf("Unsupported TIFF compression %d", compression))
+	}
+	predictor := d.field(tagPredictor, 1)
+	if predictor != 1 && predictor != 2 {
+		return camera.ImageData{}, errors.New(fmt.Sprintf("Unsupported predictor %d", predictor))
+	}
+
+	// pixels as stored, including extra samples such as alpha
+	size := samples * bits / 8
+
+	// strips are read as tiles as wide as the image
+	_, tiled := d.fields[tagTileWidth]
+	tileWidth := toInt(uint64(d.field(tagTileWidth, uint(cols))))
+	tileLength := toInt(uint64(d.field(tagTileLength, 0)))
+	offsets, counts := d.fields[tagTileOffsets], d.fields[tagTileByteCounts]
+	if !tiled {
+		tileLength = toInt(uint64(d.field(tagRowsPerStrip, uint(rows))))
+		if tileLength > rows {
+			tileLength = rows
+		}
+		offsets, counts = d.fields[tagStripOffsets], d.fields[tagStripByteCounts]
+	}
+	if tileWidth <= 0 || tileLength <= 0 {
+		return camera.ImageData{}, errors.New("Invalid strip or tile size")
+	}
+
+	across := (cols + tileWidth - 1) / tileWidth
+	down := (rows + tileLength - 1) / tileLength
+	if across > len(offsets) || down > len(offsets)/across || len(offsets) < across*down || len(counts) < across*down {
+		return camera.ImageData{}, errors.New("TIFF is missing strips or tiles")
+	}
+
+	// the header is not trusted with the size of the image, it has to fit
+	// in what its strips or tiles can decompress to before it is allocated
+	total := 0
+	for i := 0; i < across*down; i++ {
+		o, c := toInt(uint64(offsets[i])), toInt(uint64(counts[i]))
+		if o < 0 || c < 0 || c > len(d.buf)-o {
+			return camera.ImageData{}, errors.New("Strip or tile runs past the end of the file")
+		}
+		total += c
+		if total > len(d.buf) {
+			// strips may share data, but never hold more than the file
+			total = len(d.buf)
+		}
+	}
+	if !covers(total, expansion, rows, cols, size) {
+		return camera.ImageData{}, errors.New(fmt.Sprintf("TIFF strips are too short for a %dx%d image", cols, rows))
+	}
+
+	pixels := make([]byte, rows*cols*size)
+
+	for i := 0; i < across*down; i++ {
+		x := (i % across) * tileWidth
+		y := (i / across) * tileLength
+
+		// tiles are always full size, strips stop at the last row
+		h := tileLength
+		if !tiled && y+h > rows {
+			h = rows - y
+		}
+
+		o, c := int(offsets[i]), int(counts[i])
+		if !covers(c, expansion, h, tileWidth, size) {
+			return camera.ImageData{}, errors.New("Strip or tile is too short for its size")
+		}
+
+		rowLen := tileWidth * size
+		tile, err := decompressStrip(d.buf[o:o+c], h*rowLen, compression)
+		if err != nil {
+			return camera.ImageData{}, err
+		}
+
+		if bits == 16 && d.order == binary.BigEndian {
+			for j := 0; j+1 < len(tile); j += 2 {
+				tile[j], tile[j+1] = tile[j+1], tile[j]
+			}
+		}
+		if predictor == 2 {
+			unpredict(tile, rowLen, samples, bits)
+		}
+
+		w := tileWidth
+		if x+w > cols {
+			w = cols - x
+		}
+		for r := 0; r < h && y+r < rows; r++ {
+			dst := ((y+r)*cols + x) * size
+			copy(pixels[dst:dst+w*size], tile[r*rowLen:r*rowLen+w*size])
+		}
+	}
+
+	img := camera.ImageData{
+		Rows:     rows,
+		Cols:     cols,
+		Depth:    bits,
+		Channels: channels,
+	}
+
+	// drop extra samples
+	px := img.PixelSize()
+	if px == size {
+		img.Data = pixels
+	} else {
+		img.Data = make([]byte, rows*cols*px)
+		for i := 0; i < rows*cols; i++ {
+			copy(img.Data[i*px:(i+1)*px], pixels[i*size:i*size+px])
+		}
+	}
+
+	if photometric == 0 {
+		// white is zero
+		for i := range img.Data {
+			img.Data[i] = ^img.Data[i]
+		}
+	}
+
+	return img, nil
+}
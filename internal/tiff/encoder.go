@@ -0,0 +1,265 @@
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+// Encoder streams a TIFF to a writer, such as a file or the body of an
+// upload. Every offset is worked out before the header is written, so
+// compressed strips are compressed once to measure them and again as they
+// are written, and no more than a strip is held in memory at a time.
+type Encoder struct {
+	w    io.Writer
+	opts Options
+}
+
+func NewEncoder(w io.Writer, opts Options) *Encoder {
+	return &Encoder{w: w, opts: opts}
+}
+
+// page is one image of a file with the sizes of its compressed strips, and
+// the IFD describing it once the header is known.
+type page struct {
+	img          camera.ImageData
+	subfileType  uint64
+	number       int     // page number, counting full images only
+	scale        float64 // size relative to the image a thumbnail reduces
+	rowsPerStrip int
+	stripCounts  []uint64
+	ifd          *TiffIfd
+	stripOffsets *TiffField
+}
+
+// Encode writes 8 or 16-bit RGB or greyscale image data as a baseline TIFF,
+// split into separately compressed strips. The image may be followed by a
+// thumbnail and further pages, each in an IFD chained to the one before.
+// Files too large for 32-bit offsets are written as BigTIFF.
+func (e *Encoder) Encode(img camera.ImageData) error {
+	opts := e.opts
+
+	endian := opts.Endian
+	if endian == 0 {
+		endian = EndianII
+	}
+	if endian != EndianII && endian != EndianMM {
+		return errors.New(fmt.Sprintf("Unknown byte order %#x", endian))
+	}
+
+	compression := opts.Compression
+	if compression == 0 {
+		compression = CompressionNone
+	}
+
+	images := append([]camera.ImageData{img}, opts.Pages...)
+	for _, i := range images {
+		if err := checkImage(i); err != nil {
+			return err
+		}
+	}
+
+	pages := make([]*page, 0, len(images)+1)
+	for n, i := range images {
+		p := &page{img: i, number: n}
+		if len(images) > 1 {
+			p.subfileType = subfilePage
+		}
+		pages = append(pages, p)
+
+		if n == 0 && opts.Thumbnail > 0 {
+			thumb := thumbnail(img, opts.Thumbnail)
+			pages = append(pages, &page{
+				img:         thumb,
+				subfileType: subfileReduced,
+				scale:       float64(thumb.Cols) / float64(img.Cols),
+			})
+		}
+	}
+
+	payload := uint64(0)
+	for _, p := range pages {
+		if err := p.measure(compression, opts.RowsPerStrip, endian); err != nil {
+			return err
+		}
+		for _, count := range p.stripCounts {
+			payload += count
+		}
+	}
+
+	// HEADER
+	h := TiffHeader{
+		Endian:         endian,
+		TiffIdentifier: identifierClassic,
+	}
+
+	// a generous bound on everything but the strips
+	overhead := 0
+	for _, p := range pages {
+		overhead += 1024 + 2*8*len(p.stripCounts) + len(opts.ICC)
+	}
+	for _, f := range opts.Metadata.fields(&h) {
+		overhead += len(f.OffsetValue)
+	}
+	if opts.BigTiff || payload+uint64(overhead) > classicLimit {
+		h.TiffIdentifier = identifierBig
+	}
+
+	for i, p := range pages {
+		p.ifd = p.fields(&h, compression, len(images), opts, i == 0)
+	}
+
+	// each IFD is followed by its values and strips, and starts on a word
+	// boundary
+	offset := uint64(h.Len())
+	for i, p := range pages {
+		offset = offset + offset%2
+		if i == 0 {
+			h.IfdOffset = offset
+		} else {
+			pages[i-1].ifd.NextIfdOffset = offset
+		}
+
+		offset = placeValues(&h, p.ifd, offset)
+		for j, count := range p.stripCounts {
+			copy(p.stripOffsets.OffsetValue[j*h.offsetSize():], h.encodeOffset(offset))
+			offset = offset + count
+		}
+	}
+
+	written := 0
+	write := func(b []byte) error {
+		n, err := e.w.Write(b)
+		written += n
+		return err
+	}
+
+	if err := write(h.Encode()); err != nil {
+		return err
+	}
+
+	for _, p := range pages {
+		if written%2 == 1 {
+			if err := write([]byte{0x0}); err != nil {
+				return err
+			}
+		}
+
+		if err := write(appendIfd(nil, &h, p.ifd)); err != nil {
+			return err
+		}
+
+		for j, count := range p.stripCounts {
+			strip, err := p.strip(j, compression, endian)
+			if err != nil {
+				return err
+			}
+			if uint64(len(strip)) != count {
+				return errors.New(fmt.Sprintf("Strip %d compressed to %d bytes, measured %d", j, len(strip), count))
+			}
+			if err := write(strip); err != nil {
+				return err
+			}
+		}
+	}
+
+	if uint64(written) != offset {
+		return errors.New(fmt.Sprintf("Wrote %d bytes of TIFF, expected %d", written, offset))
+	}
+
+	return nil
+}
+
+// checkImage reports image data the encoder cannot write.
+func checkImage(img camera.ImageData) error {
+	bits := img.BitDepth()
+	channels := img.NumChannels()
+
+	if bits != 8 && bits != 16 {
+		return errors.New(fmt.Sprintf("Unsupported bit depth %d", bits))
+	}
+	if channels != 1 && channels != 3 {
+		return errors.New(fmt.Sprintf("Unsupported channel count %d", channels))
+	}
+	if img.Rows <= 0 || img.Cols <= 0 {
+		return errors.New(fmt.Sprintf("Invalid image size %dx%d", img.Cols, img.Rows))
+	}
+	if len(img.Data) != img.Rows*img.Cols*img.PixelSize() {
+		return errors.New(fmt.Sprintf("Image data is %d bytes, expected %d", len(img.Data), img.Rows*img.Cols*img.PixelSize()))
+	}
+
+	return nil
+}
+
+// measure cuts the image into strips and finds their compressed sizes.
+// Uncompressed strips are sized without copying them.
+func (p *page) measure(compression Compression, rowsPerStrip int, endian uint16) error {
+	img := p.img
+
+	rowLen := img.Cols * img.PixelSize()
+	if rowsPerStrip <= 0 {
+		rowsPerStrip = stripSize / rowLen
+	}
+	if rowsPerStrip < 1 {
+		rowsPerStrip = 1
+	}
+	if rowsPerStrip > img.Rows {
+		rowsPerStrip = img.Rows
+	}
+	p.rowsPerStrip = rowsPerStrip
+
+	p.stripCounts = make([]uint64, (img.Rows+rowsPerStrip-1)/rowsPerStrip)
+	for i := range p.stripCounts {
+		if compression == CompressionNone {
+			start, end := p.stripRows(i)
+			p.stripCounts[i] = uint64((end - start) * rowLen)
+			continue
+		}
+
+		strip, err := p.strip(i, compression, endian)
+		if err != nil {
+			return err
+		}
+		p.stripCounts[i] = uint64(len(strip))
+	}
+
+	return nil
+}
+
+// stripRows is the range of rows in strip i.
+func (p *page) stripRows(i int) (int, int) {
+	start := i * p.rowsPerStrip
+	end := start + p.rowsPerStrip
+	if end > p.img.Rows {
+		end = p.img.Rows
+	}
+	return start, end
+}
+
+// strip returns strip i as it is stored in the file.
+func (p *page) strip(i int, compression Compression, endian uint16) ([]byte, error) {
+	img := p.img
+	bits := img.BitDepth()
+	rowLen := img.Cols * img.PixelSize()
+
+	start, end := p.stripRows(i)
+	strip := img.Data[start*rowLen : end*rowLen]
+
+	// 16-bit samples are stored little-endian in ImageData
+	swap := bits == 16 && endian == EndianMM
+	if compression.usesPredictor() || swap {
+		strip = append([]byte(nil), strip...)
+	}
+	if compression.usesPredictor() {
+		predict(strip, rowLen, img.NumChannels(), bits)
+	}
+	if swap {
+		for i := 0; i+1 < len(strip); i += 2 {
+			strip[i], strip[i+1] = strip[i+1], strip[i]
+		}
+	}
+
+	return compressStrip(strip, rowLen, compression)
+}
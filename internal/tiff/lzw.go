@@ -0,0 +1,174 @@
+package tiff
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TIFF LZW differs from the LZW in compress/lzw: codes are packed most
+// significant bit first and the code width grows one code early. The
+// encoder follows libtiff so that every reader agrees on where the width
+// changes.
+
+const (
+	lzwClear   = 256
+	lzwEOI     = 257
+	lzwFirst   = 258
+	lzwMinBits = 9
+	lzwMaxCode = 4094 // the table is reset before the 12-bit codes run out
+)
+
+type bitWriter struct {
+	buf  []byte
+	acc  uint32
+	bits uint
+}
+
+func (w *bitWriter) write(code uint32, width uint) {
+	w.acc = w.acc<<width | code
+	w.bits += width
+	for w.bits >= 8 {
+		w.buf = append(w.buf, byte(w.acc>>(w.bits-8)))
+		w.bits -= 8
+	}
+	w.acc &= 1<<w.bits - 1
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.bits > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.bits)))
+		w.bits = 0
+	}
+	return w.buf
+}
+
+func lzwCompress(src []byte) []byte {
+	w := bitWriter{buf: make([]byte, 0, len(src)/2)}
+	width := uint(lzwMinBits)
+	table := make(map[uint32]uint16)
+	next := uint32(lzwFirst)
+
+	// advance accounts for a new table entry, resetting the table when it is
+	// full or widening the codes when the next entry would not fit
+	advance := func() {
+		next++
+		if next == lzwMaxCode {
+			w.write(lzwClear, width)
+			table = make(map[uint32]uint16)
+			next = lzwFirst
+			width = lzwMinBits
+		} else if next > 1<<width-1 {
+			width++
+		}
+	}
+
+	w.write(lzwClear, width)
+
+	if len(src) == 0 {
+		w.write(lzwEOI, width)
+		return w.flush()
+	}
+
+	prefix := uint32(src[0])
+	for _, b := range src[1:] {
+		key := prefix<<8 | uint32(b)
+		if code, ok := table[key]; ok {
+			prefix = uint32(code)
+			continue
+		}
+
+		w.write(prefix, width)
+		table[key] = uint16(next)
+		advance()
+		prefix = uint32(b)
+	}
+
+	// the decoder adds an entry for the last code too, which may change the
+	// width of the end of information code
+	w.write(prefix, width)
+	advance()
+	w.write(lzwEOI, width)
+
+	return w.flush()
+}
+
+type bitReader struct {
+	buf  []byte
+	pos  int
+	acc  uint32
+	bits uint
+}
+
+func (r *bitReader) read(width uint) (uint32, bool) {
+	for r.bits < width {
+		if r.pos >= len(r.buf) {
+			return 0, false
+		}
+		r.acc = r.acc<<8 | uint32(r.buf[r.pos])
+		r.pos++
+		r.bits += 8
+	}
+	code := r.acc >> (r.bits - width)
+	r.bits -= width
+	r.acc &= 1<<r.bits - 1
+	return code, true
+}
+
+// lzwDecompress expands TIFF LZW data. Every table entry is the previous
+// output extended by one byte, so entries are kept as spans of the output
+// rather than copied. It stops once size bytes have been produced, so a
+// strip cannot expand past the image it belongs to.
+func lzwDecompress(src []byte, size int) ([]byte, error) {
+	type span struct{ off, n int }
+
+	out := make([]byte, 0, size)
+	r := bitReader{buf: src}
+	width := uint(lzwMinBits)
+	table := make([]span, 1<<12)
+	next := lzwFirst
+	prev := span{-1, 0}
+
+	for len(out) < size {
+		code, ok := r.read(width)
+		if !ok {
+			// some writers omit the end of information code
+			return out, nil
+		}
+
+		switch {
+		case code == lzwClear:
+			next = lzwFirst
+			width = lzwMinBits
+			prev = span{-1, 0}
+			continue
+		case code == lzwEOI:
+			return out, nil
+		}
+
+		start := len(out)
+		switch {
+		case code < lzwClear:
+			out = append(out, byte(code))
+		case int(code) < next:
+			t := table[code]
+			out = append(out, out[t.off:t.off+t.n]...)
+		case int(code) == next && prev.off >= 0:
+			out = append(out, out[prev.off:prev.off+prev.n]...)
+			out = append(out, out[prev.off])
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid LZW code %d", code))
+		}
+
+		if prev.off >= 0 && next < len(table) {
+			table[next] = span{prev.off, prev.n + 1}
+			next++
+		}
+		prev = span{start, len(out) - start}
+
+		if next+1 >= 1<<width && width < 12 {
+			width++
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,196 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Metadata are the descriptive fields written along with an image. Empty
+// fields are left out.
+type Metadata struct {
+	DateTime    time.Time
+	Software    string
+	Make        string
+	Model       string
+	Description string
+	Artist      string
+	Copyright   string
+	DPI         float64 // 0 writes the customary 72
+	XMP         []byte  // an XMP packet, stored in the XMLPacket field
+}
+
+// resolution is the DPI as a rational, keeping two decimal places.
+func (m Metadata) resolution() (uint64, uint64) {
+	if m.DPI <= 0 {
+		return 72, 1
+	}
+	return uint64(m.DPI*100 + 0.5), 100
+}
+
+// fields are the descriptive fields of m, unsorted.
+func (m Metadata) fields(h *TiffHeader) []*TiffField {
+	fields := make([]*TiffField, 0)
+
+	ascii := func(tag uint16, value string) {
+		if value == "" {
+			return
+		}
+		// NUL terminated
+		b := append([]byte(value), 0x0)
+		fields = append(fields, &TiffField{
+			Tag:         tag,
+			Type:        typeASCII,
+			Count:       uint64(len(b)),
+			OffsetValue: b,
+		})
+	}
+
+	// ImageDescription
+	ascii(0x10E, m.Description)
+	// Make
+	ascii(0x10F, m.Make)
+	// Model
+	ascii(0x110, m.Model)
+	// Software
+	ascii(0x131, m.Software)
+	// DateTime
+	if !m.DateTime.IsZero() {
+		ascii(0x132, m.DateTime.Format("2006:01:02 15:04:05"))
+	}
+	// Artist
+	ascii(0x13B, m.Artist)
+	// Copyright
+	ascii(0x8298, m.Copyright)
+
+	// XMLPacket
+	if len(m.XMP) > 0 {
+		fields = append(fields, &TiffField{
+			Tag:         0x2BC,
+			Type:        typeUndefined,
+			Count:       uint64(len(m.XMP)),
+			OffsetValue: m.XMP,
+		})
+	}
+
+	return fields
+}
+
+// exifFields are the fields of m written to Exif, including the resolution.
+func (m Metadata) exifFields(h *TiffHeader) []*TiffField {
+	m.XMP = nil
+	fields := m.fields(h)
+
+	x, y := m.resolution()
+
+	// XResolution
+	fields = append(fields, &TiffField{
+		Tag:         0x11A,
+		Type:        typeRational,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeLong, x, y),
+	})
+
+	// YResolution
+	fields = append(fields, &TiffField{
+		Tag:         0x11B,
+		Type:        typeRational,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeLong, x, y),
+	})
+
+	// ResolutionUnit
+	fields = append(fields, &TiffField{
+		Tag:         0x128,
+		Type:        typeShort,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeShort, 0x2), // inch
+	})
+
+	return fields
+}
+
+// EncodeExif writes the metadata as a TIFF structure without an image, as
+// carried by the Exif APP1 segment of a JPEG. XMP has its own segment there
+// and is left out.
+func EncodeExif(m Metadata) []byte {
+	h := TiffHeader{
+		Endian:         EndianII,
+		TiffIdentifier: identifierClassic,
+	}
+	h.IfdOffset = uint64(h.Len())
+
+	ifd := newIfd(m.exifFields(&h))
+	placeValues(&h, ifd, uint64(h.Len()))
+
+	return appendIfd(h.Encode(), &h, ifd)
+}
+
+// MergeExif adds the metadata to the Exif a camera wrote, replacing the
+// fields of its IFD0 that m sets and keeping the rest, such as the exposure
+// in the Exif IFD. The camera's data stays where it is, as maker notes may
+// hold offsets of their own: a new IFD0 is appended, with the kept fields
+// still pointing at their values, and the header pointed at it.
+func MergeExif(exif []byte, m Metadata) ([]byte, error) {
+	if len(exif) < 8 {
+		return nil, errors.New("Exif is too short")
+	}
+
+	h := TiffHeader{TiffIdentifier: identifierClassic}
+	switch binary.LittleEndian.Uint16(exif[0:2]) {
+	case EndianII, EndianMM:
+		h.Endian = binary.BigEndian.Uint16(exif[0:2])
+	default:
+		return nil, errors.New("Exif has an unknown byte order")
+	}
+	if h.Order().Uint16(exif[2:4]) != identifierClassic {
+		return nil, errors.New("Exif is not a classic TIFF structure")
+	}
+
+	offset := int(h.Order().Uint32(exif[4:8]))
+	if offset < 8 || offset > len(exif)-2 {
+		return nil, errors.New("Exif IFD0 is outside of the segment")
+	}
+	n := int(h.Order().Uint16(exif[offset:]))
+	end := offset + 2 + 12*n
+	if end+4 > len(exif) {
+		return nil, errors.New("Exif IFD0 runs past the end of the segment")
+	}
+
+	fields := m.exifFields(&h)
+	replaced := make(map[uint16]bool)
+	for _, f := range fields {
+		replaced[f.Tag] = true
+	}
+
+	for i := 0; i < n; i++ {
+		entry := exif[offset+2+12*i : offset+2+12*(i+1)]
+		tag := h.Order().Uint16(entry[0:2])
+		if replaced[tag] {
+			continue
+		}
+
+		// the value or its offset is copied as is, both stay valid
+		fields = append(fields, &TiffField{
+			Tag:         tag,
+			Type:        h.Order().Uint16(entry[2:4]),
+			Count:       uint64(h.Order().Uint32(entry[4:8])),
+			OffsetValue: append([]byte(nil), entry[8:12]...),
+		})
+	}
+
+	ifd := newIfd(fields)
+	ifd.NextIfdOffset = uint64(h.Order().Uint32(exif[end : end+4]))
+
+	out := append([]byte(nil), exif...)
+	if len(out)%2 == 1 {
+		out = append(out, 0x0)
+	}
+	h.IfdOffset = uint64(len(out))
+	placeValues(&h, ifd, h.IfdOffset)
+	out = appendIfd(out, &h, ifd)
+
+	copy(out[0:8], h.Encode())
+
+	return out, nil
+}
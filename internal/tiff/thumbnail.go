@@ -0,0 +1,71 @@
+package tiff
+
+import (
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+// thumbnail reduces an image to 8-bit samples with its longest edge at most
+// size pixels, averaging the pixels each thumbnail pixel covers.
+func thumbnail(img camera.ImageData, size int) camera.ImageData {
+	scale := float64(size) / float64(img.Cols)
+	if img.Rows > img.Cols {
+		scale = float64(size) / float64(img.Rows)
+	}
+	if scale > 1 {
+		scale = 1
+	}
+
+	cols := int(float64(img.Cols)*scale + 0.5)
+	rows := int(float64(img.Rows)*scale + 0.5)
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+
+	channels := img.NumChannels()
+	wide := img.BitDepth() == 16
+
+	sample := func(i int) int {
+		if wide {
+			return int(img.Data[2*i]) | int(img.Data[2*i+1])<<8
+		}
+		return int(img.Data[i]) << 8
+	}
+
+	out := camera.ImageData{
+		Rows:     rows,
+		Cols:     cols,
+		Data:     make([]byte, rows*cols*channels),
+		Depth:    8,
+		Channels: img.Channels,
+	}
+
+	sums := make([]int, channels)
+	for y := 0; y < rows; y++ {
+		y0, y1 := y*img.Rows/rows, (y+1)*img.Rows/rows
+		for x := 0; x < cols; x++ {
+			x0, x1 := x*img.Cols/cols, (x+1)*img.Cols/cols
+
+			for c := range sums {
+				sums[c] = 0
+			}
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					px := (sy*img.Cols + sx) * channels
+					for c := range sums {
+						sums[c] += sample(px + c)
+					}
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			for c, sum := range sums {
+				out.Data[(y*cols+x)*channels+c] = byte(sum / n >> 8)
+			}
+		}
+	}
+
+	return out
+}
@@ -1,7 +1,10 @@
 package tiff
 
 import (
-	"unsafe"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
 
 	"github.com/dstuessy/film-scanner/internal/camera"
 )
@@ -11,232 +14,431 @@ const (
 	EndianMM = 0x4D4D
 )
 
-func encodeHex(num uint16) [2]byte {
-	return [2]byte{byte(num), byte(num >> 8)}
+const (
+	identifierClassic = 0x2a
+	identifierBig     = 0x2b
+)
+
+// field types written by the encoder
+const (
+	typeASCII     = 0x2
+	typeShort     = 0x3
+	typeLong      = 0x4
+	typeRational  = 0x5
+	typeUndefined = 0x7
+	typeLong8     = 0x10
+)
+
+// classicLimit is the largest file classic TIFF can address with its 32-bit
+// offsets. Larger files are written as BigTIFF.
+const classicLimit = math.MaxUint32
+
+func encodeHex(order binary.ByteOrder, num uint16) []byte {
+	buf := make([]byte, 2)
+	order.PutUint16(buf, num)
+	return buf
 }
 
-func encodeHex32(num uint32) [4]byte {
-	return [4]byte{byte(num), byte(num >> 8), byte(num >> 16), byte(num >> 24)}
+func encodeHex32(order binary.ByteOrder, num uint32) []byte {
+	buf := make([]byte, 4)
+	order.PutUint32(buf, num)
+	return buf
+}
+
+func encodeHex64(order binary.ByteOrder, num uint64) []byte {
+	buf := make([]byte, 8)
+	order.PutUint64(buf, num)
+	return buf
 }
 
 type TiffHeader struct {
 	Endian         uint16
-	TiffIdentifier uint16
-	IfdOffset      uint32
+	TiffIdentifier uint16 // 0x2a for classic TIFF, 0x2b for BigTIFF
+	IfdOffset      uint64
+}
+
+func (th *TiffHeader) Order() binary.ByteOrder {
+	if th.Endian == EndianMM {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (th *TiffHeader) IsBig() bool {
+	return th.TiffIdentifier == identifierBig
+}
+
+// offsetSize is the size of offsets and of the value slot of a field.
+func (th *TiffHeader) offsetSize() int {
+	if th.IsBig() {
+		return 8
+	}
+	return 4
+}
+
+// encodeOffset encodes an offset or count in the width the format uses.
+func (th *TiffHeader) encodeOffset(num uint64) []byte {
+	if th.IsBig() {
+		return encodeHex64(th.Order(), num)
+	}
+	return encodeHex32(th.Order(), uint32(num))
+}
+
+// offsetType is the field type for offsets into the file.
+func (th *TiffHeader) offsetType() uint16 {
+	if th.IsBig() {
+		return typeLong8
+	}
+	return typeLong
+}
+
+// encodeValues encodes the values of a field of the given type.
+func (th *TiffHeader) encodeValues(typ uint16, values ...uint64) []byte {
+	buf := make([]byte, 0)
+	for _, v := range values {
+		switch typ {
+		case typeShort:
+			buf = append(buf, encodeHex(th.Order(), uint16(v))...)
+		case typeLong:
+			buf = append(buf, encodeHex32(th.Order(), uint32(v))...)
+		case typeLong8:
+			buf = append(buf, encodeHex64(th.Order(), v)...)
+		}
+	}
+	return buf
 }
 
 func (th *TiffHeader) Encode() []byte {
-	buf := make([]byte, 8)
-	en := encodeHex(th.Endian)
-	copy(buf[0:2], en[:])
-	id := encodeHex(th.TiffIdentifier)
-	copy(buf[2:4], id[:])
-	o := encodeHex32(th.IfdOffset)
-	copy(buf[4:8], o[:])
+	// the byte order mark reads the same either way round
+	buf := []byte{byte(th.Endian >> 8), byte(th.Endian)}
+	buf = append(buf, encodeHex(th.Order(), th.TiffIdentifier)...)
+	if th.IsBig() {
+		buf = append(buf, encodeHex(th.Order(), 8)...) // bytesize of offsets
+		buf = append(buf, encodeHex(th.Order(), 0)...)
+	}
+	buf = append(buf, th.encodeOffset(th.IfdOffset)...)
 	return buf
 }
 
 func (th *TiffHeader) Len() int {
-	return int(unsafe.Sizeof(th.Endian) + unsafe.Sizeof(th.TiffIdentifier) + unsafe.Sizeof(th.IfdOffset))
+	if th.IsBig() {
+		return 16
+	}
+	return 8
 }
 
 type TiffIfd struct {
-	NumFields     uint16       // [2]byte
-	Fields        []*TiffField // [TiffIfd.NumFields*12]byte
-	NextIfdOffset uint32       // [4]byte
+	NumFields     uint64       // [2]byte, or [8]byte in BigTIFF
+	Fields        []*TiffField // [TiffIfd.NumFields*12]byte, or 20 bytes per field in BigTIFF
+	NextIfdOffset uint64       // [4]byte, or [8]byte in BigTIFF
 }
 
-func (ifd *TiffIfd) Encode() []byte {
-	fieldLen := 12
-	buf := make([]byte, 2+uint16(fieldLen)*ifd.NumFields+4)
-	nf := encodeHex(ifd.NumFields)
-	copy(buf[0:2], nf[:])
+func (ifd *TiffIfd) Encode(h *TiffHeader) []byte {
+	buf := make([]byte, 0, ifd.Len(h))
+
+	if h.IsBig() {
+		buf = append(buf, encodeHex64(h.Order(), ifd.NumFields)...)
+	} else {
+		buf = append(buf, encodeHex(h.Order(), uint16(ifd.NumFields))...)
+	}
 
-	for i, field := range ifd.Fields {
-		start := 2 + 12*i
-		end := start + field.Len()
-		copy(buf[start:end], field.Encode()) // 2 is the offset from which the NumFields ended
+	for _, field := range ifd.Fields {
+		buf = append(buf, field.Encode(h)...)
 	}
 
-	ifdOffsetStart := 2 + fieldLen*int(ifd.NumFields) // 2 is the offset from which the NumFields ended
-	ifdOffsetEnd := ifdOffsetStart + 4
-	nextIfd := encodeHex32(ifd.NextIfdOffset)
-	copy(buf[ifdOffsetStart:ifdOffsetEnd], nextIfd[:])
+	buf = append(buf, h.encodeOffset(ifd.NextIfdOffset)...)
 
 	return buf
 }
 
-func (ifd *TiffIfd) Len() int {
-	return int(unsafe.Sizeof(ifd.NumFields)) + len(ifd.Fields)*12 + int(unsafe.Sizeof(ifd.NextIfdOffset))
+func (ifd *TiffIfd) Len(h *TiffHeader) int {
+	if h.IsBig() {
+		return 8 + len(ifd.Fields)*20 + 8
+	}
+	return 2 + len(ifd.Fields)*12 + 4
 }
 
 type TiffField struct {
 	Tag         uint16 // [2]byte
 	Type        uint16 // [2]byte
-	Count       uint32 // [4]byte
-	Value       uint32 // [4]byte represents value if spec allows, otherwise it represents the offset at which TiffField.OffsetValue os located
-	OffsetValue []byte // bytes for the value in a location represented by TiffField.Value. These are not encoded in the tiff field itself, and also omitted from the TiffField.Len() calculation
-}
-
-func (tf *TiffField) Encode() []byte {
-	field := make([]byte, 12)
-	tag := encodeHex(tf.Tag)
-	copy(field[0:2], tag[:])
-	tp := encodeHex(tf.Type)
-	copy(field[2:4], tp[:])
-	c := encodeHex32(tf.Count)
-	copy(field[4:8], c[:])
-	v := encodeHex32(tf.Value)
-	copy(field[8:12], v[:])
+	Count       uint64 // [4]byte, or [8]byte in BigTIFF
+	Value       uint64 // [4]byte, or [8]byte in BigTIFF, the offset at which TiffField.OffsetValue is located if it does not fit in the field
+	OffsetValue []byte // encoded values, written into the field itself if they fit and at TiffField.Value otherwise. Values stored elsewhere are omitted from the TiffField.Len() calculation
+}
+
+// Inline reports whether the values fit into the field itself, in which
+// case the spec requires them to be stored there.
+func (tf *TiffField) Inline(h *TiffHeader) bool {
+	return len(tf.OffsetValue) <= h.offsetSize()
+}
+
+func (tf *TiffField) Encode(h *TiffHeader) []byte {
+	field := make([]byte, 0, tf.Len(h))
+	field = append(field, encodeHex(h.Order(), tf.Tag)...)
+	field = append(field, encodeHex(h.Order(), tf.Type)...)
+	field = append(field, h.encodeOffset(tf.Count)...)
+
+	if tf.Inline(h) {
+		// values are left justified in the field
+		v := make([]byte, h.offsetSize())
+		copy(v, tf.OffsetValue)
+		field = append(field, v...)
+	} else {
+		field = append(field, h.encodeOffset(tf.Value)...)
+	}
+
 	return field
 }
 
-func (tf *TiffField) Len() int {
-	return int(unsafe.Sizeof(tf.Tag) + unsafe.Sizeof(tf.Type) + unsafe.Sizeof(tf.Count) + unsafe.Sizeof(tf.Value))
+func (tf *TiffField) Len(h *TiffHeader) int {
+	if h.IsBig() {
+		return 20
+	}
+	return 12
 }
 
-func EncodeTiff(img camera.ImageData) ([]byte, error) {
-	// HEADER
-	h := TiffHeader{
-		Endian:         EndianII,
-		TiffIdentifier: 0x2a,
-		IfdOffset:      0x8,
+// newIfd makes an IFD from fields, sorted by tag as the spec requires. It is
+// the last IFD of the file until another is chained after it.
+func newIfd(fields []*TiffField) *TiffIfd {
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Tag < fields[j].Tag
+	})
+
+	return &TiffIfd{
+		NumFields:     uint64(len(fields)),
+		Fields:        fields,
+		NextIfdOffset: 0x0, // this is the last ifd
 	}
+}
+
+// placeValues points the fields whose values do not fit into them at the
+// locations following an IFD written at offset, and returns the offset after
+// the last value. Values are padded to start on a word boundary.
+func placeValues(h *TiffHeader, ifd *TiffIfd, offset uint64) uint64 {
+	offset = offset + uint64(ifd.Len(h))
+
+	for _, field := range ifd.Fields {
+		if !field.Inline(h) {
+			field.Value = offset
+			offset = offset + uint64(len(field.OffsetValue)+len(field.OffsetValue)%2)
+		}
+	}
+
+	return offset
+}
+
+// appendIfd appends an IFD followed by the values placed by placeValues.
+func appendIfd(buf []byte, h *TiffHeader, ifd *TiffIfd) []byte {
+	buf = append(buf, ifd.Encode(h)...)
+
+	for _, field := range ifd.Fields {
+		if !field.Inline(h) {
+			buf = append(buf, field.OffsetValue...)
+			if len(field.OffsetValue)%2 == 1 {
+				buf = append(buf, 0x0)
+			}
+		}
+	}
+
+	return buf
+}
+
+// stripSize is the uncompressed size strips are cut to when no row count is
+// given.
+const stripSize = 64 * 1024
+
+// NewSubfileType values
+const (
+	subfileReduced = 0x1 // a reduced-resolution version of another image
+	subfilePage    = 0x2 // one page of a multi-page file
+)
+
+// Options control how a TIFF is laid out and compressed.
+type Options struct {
+	Compression  Compression
+	RowsPerStrip int    // 0 picks strips of about stripSize bytes
+	Endian       uint16 // EndianII or EndianMM, 0 means EndianII
+	BigTiff      bool   // always write BigTIFF, otherwise only when the file needs it
+	Metadata     Metadata
+	ICC          []byte             // an ICC profile describing the image data
+	Thumbnail    int                // longest edge of a preview written after the image, 0 for none
+	Pages        []camera.ImageData // further frames, such as bracket members, written as pages
+}
+
+// EncodeTiff writes 8 or 16-bit RGB or greyscale image data as a baseline
+// TIFF, as an Encoder would, and returns the whole file.
+func EncodeTiff(img camera.ImageData, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf, opts).Encode(img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fields builds the IFD of a page. The descriptive metadata is only written
+// for the first image, while every image carries the colour profile.
+func (p *page) fields(h *TiffHeader, compression Compression, numPages int, opts Options, first bool) *TiffIfd {
+	img := p.img
+	bits := img.BitDepth()
+	channels := img.NumChannels()
 
 	fields := make([]*TiffField, 0)
 
+	// NewSubfileType
+	if p.subfileType != 0 {
+		fields = append(fields, &TiffField{
+			Tag:         0xFE,
+			Type:        typeLong,
+			Count:       0x1,
+			OffsetValue: h.encodeValues(typeLong, p.subfileType),
+		})
+	}
+
 	// ImageWidth
 	fields = append(fields, &TiffField{
-		Tag:   0x100,
-		Type:  0x4,
-		Count: 0x1,
-		Value: uint32(img.Cols), // horizontal Length
+		Tag:         0x100,
+		Type:        typeLong,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeLong, uint64(img.Cols)), // horizontal Length
 	})
 
 	// ImageLength
 	fields = append(fields, &TiffField{
-		Tag:   0x101,
-		Type:  0x4,
-		Count: 0x1,
-		Value: uint32(img.Rows), // vertical Length
+		Tag:         0x101,
+		Type:        typeLong,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeLong, uint64(img.Rows)), // vertical Length
 	})
 
 	// BitsPerSample
-	bitsPerSample := &TiffField{
-		Tag:   0x102,
-		Type:  0x1,
-		Count: 0x3,
-		Value: (uint32(0x8) | uint32(0x8)<<8 | uint32(0x8)<<16 | uint32(0x0)<<24), // 4 btyes in uint32 little endian
+	bitsPerSample := make([]uint64, channels)
+	for i := range bitsPerSample {
+		bitsPerSample[i] = uint64(bits)
 	}
-	fields = append(fields, bitsPerSample)
+	fields = append(fields, &TiffField{
+		Tag:         0x102,
+		Type:        typeShort,
+		Count:       uint64(channels),
+		OffsetValue: h.encodeValues(typeShort, bitsPerSample...),
+	})
 
 	// Compression
 	fields = append(fields, &TiffField{
-		Tag:   0x103,
-		Type:  0x3,
-		Count: 0x1,
-		Value: 0x1, // no compression
+		Tag:         0x103,
+		Type:        typeShort,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeShort, uint64(compression)),
 	})
 
 	// PhotometricInterpretation
+	photometric := uint64(0x2) // RGB, full color
+	if channels == 1 {
+		photometric = 0x1 // greyscale, black is zero
+	}
 	fields = append(fields, &TiffField{
-		Tag:   0x106,
-		Type:  0x3,
-		Count: 0x1,
-		Value: 0x2, // RGB, full color
+		Tag:         0x106,
+		Type:        typeShort,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeShort, photometric),
 	})
 
-	// StripOffsets
-	stripOffsets := &TiffField{
+	// StripOffsets, filled in once the strips are placed
+	p.stripOffsets = &TiffField{
 		Tag:         0x111,
-		Type:        0x4,
-		Count:       0x1,
-		OffsetValue: img.Data,
+		Type:        h.offsetType(),
+		Count:       uint64(len(p.stripCounts)),
+		OffsetValue: make([]byte, h.offsetSize()*len(p.stripCounts)),
 	}
-	fields = append(fields, stripOffsets)
+	fields = append(fields, p.stripOffsets)
 
 	// SamplesPerPixel
 	fields = append(fields, &TiffField{
-		Tag:   0x115,
-		Type:  0x3,
-		Count: 0x1,
-		Value: 0x3, // 3 channels per pixel
+		Tag:         0x115,
+		Type:        typeShort,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeShort, uint64(channels)), // channels per pixel
 	})
 
 	// RowsPerStrip
 	fields = append(fields, &TiffField{
-		Tag:   0x116,
-		Type:  0x4,
-		Count: 0x1,
-		Value: uint32(img.Rows), // number of rows per strip
+		Tag:         0x116,
+		Type:        typeLong,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeLong, uint64(p.rowsPerStrip)), // number of rows per strip
 	})
 
 	// StripByteCounts
-	stripByteCounts := &TiffField{
-		Tag:   0x117,
-		Type:  0x4,
-		Count: 0x1,
-		Value: uint32(len(img.Data)),
+	fields = append(fields, &TiffField{
+		Tag:         0x117,
+		Type:        h.offsetType(),
+		Count:       uint64(len(p.stripCounts)),
+		OffsetValue: h.encodeValues(h.offsetType(), p.stripCounts...),
+	})
+
+	// a thumbnail covers the same area as the image at a lower resolution
+	m := opts.Metadata
+	if p.scale > 0 {
+		m.DPI = m.DPI * p.scale
 	}
-	fields = append(fields, stripByteCounts)
+	x, y := m.resolution()
 
 	// XResolution
-	xresolutionValue1 := encodeHex32(72)
-	xresolutionValue2 := encodeHex32(1)
-	xresolutionValue := append(xresolutionValue1[:], xresolutionValue2[:]...)
-	xresolution := &TiffField{
+	fields = append(fields, &TiffField{
 		Tag:         0x11A,
-		Type:        0x5,
+		Type:        typeRational,
 		Count:       0x1,
-		OffsetValue: xresolutionValue,
-	}
-	fields = append(fields, xresolution)
+		OffsetValue: h.encodeValues(typeLong, x, y),
+	})
 
 	// YResolution
-	yresolutionValue1 := encodeHex32(72)
-	yresolutionValue2 := encodeHex32(1)
-	yresolutionValue := append(yresolutionValue1[:], yresolutionValue2[:]...)
-	yresolution := &TiffField{
+	fields = append(fields, &TiffField{
 		Tag:         0x11B,
-		Type:        0x5,
+		Type:        typeRational,
 		Count:       0x1,
-		OffsetValue: yresolutionValue,
-	}
-	fields = append(fields, yresolution)
+		OffsetValue: h.encodeValues(typeLong, x, y),
+	})
 
 	// ResolutionUnit
 	fields = append(fields, &TiffField{
-		Tag:   0x128,
-		Type:  0x3,
-		Count: 0x1,
-		Value: 0x2, // inch,
+		Tag:         0x128,
+		Type:        typeShort,
+		Count:       0x1,
+		OffsetValue: h.encodeValues(typeShort, 0x2), // inch
 	})
 
-	// IFD 0
-	ifd := TiffIfd{
-		NumFields:     uint16(len(fields)),
-		Fields:        fields,
-		NextIfdOffset: 0x0, // this is the last ifd
+	// PageNumber
+	if p.subfileType == subfilePage {
+		fields = append(fields, &TiffField{
+			Tag:         0x129,
+			Type:        typeShort,
+			Count:       0x2,
+			OffsetValue: h.encodeValues(typeShort, uint64(p.number), uint64(numPages)),
+		})
 	}
 
-	offset := h.Len() + ifd.Len()
-
-	for _, field := range fields {
-		if len(field.OffsetValue) > 0 {
-			field.Value = uint32(offset)
-			offset = offset + len(field.OffsetValue)
-		}
+	// Predictor
+	if compression.usesPredictor() {
+		fields = append(fields, &TiffField{
+			Tag:         0x13D,
+			Type:        typeShort,
+			Count:       0x1,
+			OffsetValue: h.encodeValues(typeShort, 0x2), // horizontal differencing
+		})
 	}
 
-	buf := make([]byte, 0)
-	buf = append(buf, h.Encode()...)
-	buf = append(buf, ifd.Encode()...)
+	// InterColorProfile
+	if len(opts.ICC) > 0 {
+		fields = append(fields, &TiffField{
+			Tag:         0x8773,
+			Type:        typeUndefined,
+			Count:       uint64(len(opts.ICC)),
+			OffsetValue: opts.ICC,
+		})
+	}
 
-	for _, field := range fields {
-		if len(field.OffsetValue) > 0 {
-			buf = append(buf, field.OffsetValue...)
-		}
+	if first {
+		fields = append(fields, opts.Metadata.fields(h)...)
 	}
 
-	return buf, nil
+	return newIfd(fields)
 }
@@ -0,0 +1,361 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/dstuessy/film-scanner/internal/camera"
+)
+
+var compressions = []Compression{CompressionNone, CompressionLZW, CompressionDeflate, CompressionPackBits}
+
+var endians = []uint16{EndianII, EndianMM}
+
+// testImage fills an image with a pattern that has both runs and noise, so
+// every compression has something to do.
+func testImage(rows, cols, depth, channels int) camera.ImageData {
+	img := camera.ImageData{Rows: rows, Cols: cols, Depth: depth, Channels: channels}
+	img.Data = make([]byte, rows*cols*img.PixelSize())
+	for i := range img.Data {
+		if (i/64)%2 == 0 {
+			img.Data[i] = byte(i / 64)
+		} else {
+			img.Data[i] = byte(i*7 + i/13)
+		}
+	}
+	return img
+}
+
+func checkSame(t *testing.T, got, want camera.ImageData) {
+	t.Helper()
+
+	if got.Rows != want.Rows || got.Cols != want.Cols {
+		t.Fatalf("size %dx%d, want %dx%d", got.Cols, got.Rows, want.Cols, want.Rows)
+	}
+	if got.BitDepth() != want.BitDepth() || got.NumChannels() != want.NumChannels() {
+		t.Fatalf("%d bits with %d channels, want %d bits with %d channels", got.BitDepth(), got.NumChannels(), want.BitDepth(), want.NumChannels())
+	}
+	if !bytes.Equal(got.Data, want.Data) {
+		t.Fatal("pixels differ")
+	}
+}
+
+// ifds walks the IFD chain of an encoded file, returning the decoder state
+// of each IFD.
+func ifds(t *testing.T, buf []byte) []decoder {
+	t.Helper()
+
+	d := decoder{buf: buf, order: binary.LittleEndian}
+	if binary.LittleEndian.Uint16(buf) == EndianMM {
+		d.order = binary.BigEndian
+	}
+
+	offset := 0
+	if d.order.Uint16(buf[2:4]) == identifierBig {
+		d.big = true
+		offset = d.offset(buf[8:16])
+	} else {
+		offset = d.offset(buf[4:8])
+	}
+
+	found := make([]decoder, 0)
+	for offset != 0 {
+		if len(found) == maxIfds {
+			t.Fatal("IFD chain does not end")
+		}
+		d.fields = make(map[uint16][]uint)
+		next, err := d.readIfd(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, d)
+		offset = next
+	}
+
+	return found
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range compressions {
+		for _, endian := range endians {
+			for _, depth := range []int{8, 16} {
+				for _, channels := range []int{1, 3} {
+					name := fmt.Sprintf("%d-%x-%d-%d", c, endian, depth, channels)
+					t.Run(name, func(t *testing.T) {
+						// several strips, the last one short
+						img := testImage(37, 29, depth, channels)
+						buf, err := EncodeTiff(img, Options{Compression: c, Endian: endian, RowsPerStrip: 8})
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						got, err := DecodeTiff(buf)
+						if err != nil {
+							t.Fatal(err)
+						}
+						checkSame(t, got, img)
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestRoundTripBigTiff(t *testing.T) {
+	for _, c := range compressions {
+		for _, endian := range endians {
+			t.Run(fmt.Sprintf("%d-%x", c, endian), func(t *testing.T) {
+				img := testImage(20, 33, 16, 3)
+				buf, err := EncodeTiff(img, Options{Compression: c, Endian: endian, BigTiff: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(buf[2:4], encodeHex(binaryOrder(endian), identifierBig)) {
+					t.Fatal("not written as BigTIFF")
+				}
+
+				got, err := DecodeTiff(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkSame(t, got, img)
+			})
+		}
+	}
+}
+
+func binaryOrder(endian uint16) binary.ByteOrder {
+	h := TiffHeader{Endian: endian}
+	return h.Order()
+}
+
+func TestThumbnail(t *testing.T) {
+	img := testImage(300, 200, 16, 3)
+	buf, err := EncodeTiff(img, Options{Compression: CompressionLZW, Thumbnail: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := ifds(t, buf)
+	if len(found) != 2 {
+		t.Fatalf("%d IFDs, want 2", len(found))
+	}
+
+	thumb := found[1]
+	if thumb.field(tagNewSubfileType, 0) != subfileReduced {
+		t.Fatal("thumbnail is not marked as reduced")
+	}
+	if thumb.field(tagImageWidth, 0) != 40 || thumb.field(tagImageLength, 0) != 60 {
+		t.Fatalf("thumbnail is %dx%d, want 40x60", thumb.field(tagImageWidth, 0), thumb.field(tagImageLength, 0))
+	}
+	if _, err := thumb.decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the full image is decoded, not the thumbnail
+	got, err := DecodeTiff(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSame(t, got, img)
+}
+
+func TestPages(t *testing.T) {
+	for _, endian := range endians {
+		for _, big := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%x-%v", endian, big), func(t *testing.T) {
+				pages := []camera.ImageData{
+					testImage(21, 17, 16, 3),
+					testImage(5, 9, 8, 1),
+					testImage(12, 4, 8, 3),
+				}
+				buf, err := EncodeTiff(pages[0], Options{
+					Compression: CompressionDeflate,
+					Endian:      endian,
+					BigTiff:     big,
+					Thumbnail:   8,
+					Pages:       pages[1:],
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found := ifds(t, buf)
+				if len(found) != len(pages)+1 {
+					t.Fatalf("%d IFDs, want %d", len(found), len(pages)+1)
+				}
+
+				n := 0
+				for _, d := range found {
+					if d.field(tagNewSubfileType, 0)&subfileReduced != 0 {
+						continue
+					}
+					if got := d.fields[0x129]; len(got) != 2 || int(got[0]) != n || int(got[1]) != len(pages) {
+						t.Fatalf("page %d has page number %v", n, got)
+					}
+
+					img, err := d.decode()
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkSame(t, img, pages[n])
+					n++
+				}
+				if n != len(pages) {
+					t.Fatalf("%d pages, want %d", n, len(pages))
+				}
+			})
+		}
+	}
+}
+
+// entries returns the entries of the first IFD of a classic TIFF, which
+// alias the file so they can be altered.
+func entries(buf []byte) (binary.ByteOrder, [][]byte) {
+	order := binaryOrder(binary.LittleEndian.Uint16(buf))
+	offset := int(order.Uint32(buf[4:8]))
+	n := int(order.Uint16(buf[offset:]))
+
+	found := make([][]byte, n)
+	for i := range found {
+		start := offset + 2 + 12*i
+		found[i] = buf[start : start+12]
+	}
+	return order, found
+}
+
+func TestDecodeOnlyReduced(t *testing.T) {
+	for _, endian := range endians {
+		buf, err := EncodeTiff(testImage(4, 4, 8, 3), Options{Endian: endian})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// mark the only image as a preview, as RAW files do, in place of the
+		// resolution unit the decoder does not read
+		order, fields := entries(buf)
+		marked := false
+		for _, entry := range fields {
+			if order.Uint16(entry) == 0x128 {
+				order.PutUint16(entry[0:], tagNewSubfileType)
+				order.PutUint16(entry[2:], typeLong)
+				order.PutUint32(entry[4:], 1)
+				order.PutUint32(entry[8:], subfileReduced)
+				marked = true
+			}
+		}
+		if !marked {
+			t.Fatal("no resolution unit to replace")
+		}
+
+		if _, err := DecodeTiff(buf); err == nil {
+			t.Fatal("decoded a file without a full-resolution image")
+		}
+	}
+}
+
+func TestDecodeOversized(t *testing.T) {
+	for _, c := range compressions {
+		buf, err := EncodeTiff(testImage(4, 4, 8, 3), Options{Compression: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// claim a huge image, leaving the strips as they are
+		order, fields := entries(buf)
+		for _, entry := range fields {
+			tag := order.Uint16(entry)
+			if tag == tagImageWidth || tag == tagImageLength || tag == tagRowsPerStrip {
+				order.PutUint16(entry[2:], typeLong)
+				order.PutUint32(entry[8:], 0xFFFFFFF)
+			}
+		}
+
+		if _, err := DecodeTiff(buf); err == nil {
+			t.Fatalf("compression %d: decoded an image larger than its strips", c)
+		}
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	for _, img := range []camera.ImageData{
+		{Rows: 3},
+		{Cols: 3},
+	} {
+		if _, err := EncodeTiff(img, Options{}); err == nil {
+			t.Fatalf("encoded a %dx%d image", img.Cols, img.Rows)
+		}
+	}
+}
+
+func TestLZWBounded(t *testing.T) {
+	// a megabyte of zeros compresses to a few kilobytes
+	data := lzwCompress(make([]byte, 1<<20))
+
+	out, err := lzwDecompress(data, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 16+4096 {
+		t.Fatalf("decompressed %d bytes for 16", len(out))
+	}
+}
+
+func FuzzLZW(f *testing.F) {
+	f.Add(lzwCompress(testImage(8, 8, 8, 3).Data), 192)
+	f.Add(lzwCompress(make([]byte, 1<<16)), 16)
+	f.Add([]byte{0x80, 0x00, 0x40}, 16)
+
+	f.Fuzz(func(t *testing.T, data []byte, size int) {
+		if size < 0 || size > 1<<16 {
+			return
+		}
+		out, err := lzwDecompress(data, size)
+		if err == nil && len(out) > size+4096 {
+			t.Fatalf("decompressed %d bytes for %d", len(out), size)
+		}
+	})
+}
+
+func FuzzPackBits(f *testing.F) {
+	f.Add(packBits(nil, testImage(8, 8, 8, 3).Data), 192)
+	f.Add([]byte{0x81, 0xAA, 0x02, 1, 2, 3}, 130)
+
+	f.Fuzz(func(t *testing.T, data []byte, size int) {
+		if size < 0 || size > 1<<16 {
+			return
+		}
+		out, err := unpackBits(data, size)
+		if err == nil && len(out) > size+128 {
+			t.Fatalf("unpacked %d bytes for %d", len(out), size)
+		}
+	})
+}
+
+func FuzzDecodeTiff(f *testing.F) {
+	for _, c := range compressions {
+		buf, err := EncodeTiff(testImage(6, 5, 16, 3), Options{Compression: c, Thumbnail: 2})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+	big, err := EncodeTiff(testImage(6, 5, 8, 1), Options{BigTiff: true, Endian: EndianMM})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(big)
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		img, err := DecodeTiff(buf)
+		if err != nil {
+			return
+		}
+		// whatever is decoded has to come from the file's data
+		if len(img.Data) > len(buf)*maxExpansion(CompressionLZW) {
+			t.Fatalf("decoded %d bytes from a %d byte file", len(img.Data), len(buf))
+		}
+	})
+}
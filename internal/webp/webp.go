@@ -0,0 +1,138 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// VP8X flags
+const (
+	flagICC   = 0x20
+	flagAlpha = 0x10
+)
+
+// Chunk is a chunk of the RIFF container of a WebP.
+type Chunk struct {
+	Type string
+	Data []byte
+}
+
+func (c Chunk) encode() []byte {
+	buf := append([]byte(c.Type), binary.LittleEndian.AppendUint32(nil, uint32(len(c.Data)))...)
+	buf = append(buf, c.Data...)
+	if len(c.Data)%2 == 1 {
+		buf = append(buf, 0x0)
+	}
+	return buf
+}
+
+// IsWebp reports whether buf starts with a RIFF header of a WebP.
+func IsWebp(buf []byte) bool {
+	return len(buf) >= 12 && bytes.Equal(buf[0:4], []byte("RIFF")) && bytes.Equal(buf[8:12], []byte("WEBP"))
+}
+
+// Chunks lists the chunks of a WebP.
+func Chunks(buf []byte) ([]Chunk, error) {
+	if !IsWebp(buf) {
+		return nil, errors.New("Not a WebP, missing RIFF header")
+	}
+
+	chunks := make([]Chunk, 0)
+	i := 12
+	for i+8 <= len(buf) {
+		n := int(binary.LittleEndian.Uint32(buf[i+4 : i+8]))
+		if n < 0 || n > len(buf)-i-8 {
+			return nil, errors.New("WebP chunk runs past the end of the file")
+		}
+
+		chunks = append(chunks, Chunk{Type: string(buf[i : i+4]), Data: buf[i+8 : i+8+n]})
+		i += 8 + n + n%2
+	}
+
+	if len(chunks) == 0 {
+		return nil, errors.New("WebP has no image")
+	}
+
+	return chunks, nil
+}
+
+// extendedHeader builds the VP8X chunk a simple WebP of one lossy or
+// lossless image needs before it can carry other chunks.
+func extendedHeader(image Chunk) (Chunk, error) {
+	var cols, rows int
+	var flags byte
+
+	switch image.Type {
+	case "VP8 ":
+		// a key frame tag, start code and the 14-bit dimensions
+		if len(image.Data) < 10 || !bytes.Equal(image.Data[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			return Chunk{}, errors.New("WebP has an invalid VP8 frame")
+		}
+		cols = int(binary.LittleEndian.Uint16(image.Data[6:8]) & 0x3FFF)
+		rows = int(binary.LittleEndian.Uint16(image.Data[8:10]) & 0x3FFF)
+	case "VP8L":
+		// a signature byte, then 14 bits each of width and height less one,
+		// and the alpha hint
+		if len(image.Data) < 5 || image.Data[0] != 0x2F {
+			return Chunk{}, errors.New("WebP has an invalid VP8L image")
+		}
+		bits := binary.LittleEndian.Uint32(image.Data[1:5])
+		cols = int(bits&0x3FFF) + 1
+		rows = int(bits>>14&0x3FFF) + 1
+		if bits>>28&1 == 1 {
+			flags |= flagAlpha
+		}
+	default:
+		return Chunk{}, errors.New("WebP does not start with an image")
+	}
+
+	data := make([]byte, 10)
+	data[0] = flags
+	put24 := func(b []byte, v int) {
+		b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+	}
+	put24(data[4:7], cols-1)
+	put24(data[7:10], rows-1)
+
+	return Chunk{Type: "VP8X", Data: data}, nil
+}
+
+// EmbedICC adds an ICC profile to a WebP, replacing any it already has. A
+// simple WebP is turned into the extended format, which profiles need.
+func EmbedICC(buf []byte, profile []byte) ([]byte, error) {
+	chunks, err := Chunks(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	header := chunks[0]
+	if header.Type == "VP8X" {
+		if len(header.Data) < 10 {
+			return nil, errors.New("WebP has an invalid VP8X chunk")
+		}
+		header.Data = append([]byte(nil), header.Data...)
+		chunks = chunks[1:]
+	} else {
+		header, err = extendedHeader(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	header.Data[0] |= flagICC
+
+	// the profile follows the header, before any other chunk
+	out := append([]byte(nil), buf[0:12]...)
+	out = append(out, header.encode()...)
+	out = append(out, Chunk{Type: "ICCP", Data: profile}.encode()...)
+	for _, c := range chunks {
+		if c.Type == "ICCP" {
+			continue
+		}
+		out = append(out, c.encode()...)
+	}
+
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+
+	return out, nil
+}
@@ -1,72 +1,110 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 
 	"github.com/dstuessy/film-scanner/internal/auth"
 	"github.com/dstuessy/film-scanner/internal/cache"
 	"github.com/dstuessy/film-scanner/internal/camera"
+	"github.com/dstuessy/film-scanner/internal/config"
+	"github.com/dstuessy/film-scanner/internal/scan"
+	"github.com/dstuessy/film-scanner/internal/settings"
 	"github.com/dstuessy/film-scanner/web/controllers"
 	"github.com/joho/godotenv"
 )
 
-func init() {
-	if err := godotenv.Load(".env"); err != nil {
-		log.Fatal("Error loading .env file")
+var configPath = flag.String("config", "", "path to a YAML config file")
+
+// setup loads the configuration and builds the app from it, starting the
+// camera. Values from .env, if present, override the config file.
+func setup() (*config.Config, *controllers.App) {
+	flag.Parse()
+
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(".env"); err != nil {
+			log.Fatal("Error loading .env file: ", err)
+		}
 	}
 
-	if err := camera.SetupTempDir(); err != nil {
+	conf, err := config.Load(*configPath)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := cache.SetupCacheDir(); err != nil {
+	c, err := cache.NewCache(conf.Cache)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	auth.Setup()
+	store, err := settings.NewStore(conf.Settings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cam, err := camera.NewCamera(conf.Camera)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := camera.StartStream(); err != nil {
+	if err := camera.StartStream(cam); err != nil {
 		log.Fatal(err)
 	}
+
+	scanner := scan.NewScanner(c, store, conf.Camera)
+	app := controllers.NewApp(auth.NewOauthConfig(conf.Auth), c, store, scanner, conf.Camera)
+
+	return conf, app
 }
 
 func main() {
+	conf, app := setup()
+
 	defer camera.CloseCamera()
 	r := mux.NewRouter()
 
 	fs := http.FileServer(http.Dir("web/assets"))
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", fs))
 
-	r.HandleFunc("/", controllers.HomeHandler)
+	r.HandleFunc("/", app.HomeHandler)
+
+	r.HandleFunc("/project/{id}", app.ProjectHandler)
+
+	r.HandleFunc("/project/{id}/scan", app.NewScanHandler)
+
+	r.HandleFunc("/login", app.LoginHandler)
+
+	r.HandleFunc("/oauth2callback", app.AuthCallbackHandler)
 
-	r.HandleFunc("/project/{id}", controllers.ProjectHandler)
+	r.HandleFunc("/resource/workspace/create", app.NewWorkspaceHandler)
 
-	r.HandleFunc("/project/{id}/scan", controllers.NewScanHandler)
+	r.HandleFunc("/resource/project/create", app.NewProjectHandler)
 
-	r.HandleFunc("/login", controllers.LoginHandler)
+	r.HandleFunc("/resource/project/{id}", app.GetProjectHandler)
 
-	r.HandleFunc("/oauth2callback", controllers.AuthCallbackHandler)
+	r.HandleFunc("/resource/project/{id}/settings", app.SaveProjectSettingsHandler)
 
-	r.HandleFunc("/resource/workspace/create", controllers.NewWorkspaceHandler)
+	r.HandleFunc("/resource/file/{id}/delete", app.DeleteFileHandler)
 
-	r.HandleFunc("/resource/project/create", controllers.NewProjectHandler)
+	r.HandleFunc("/resource/cache/{project}/upload", app.UploadCacheHandler)
 
-	r.HandleFunc("/resource/project/{id}", controllers.GetProjectHandler)
+	r.HandleFunc("/resource/cache/{project}/file/{file}/delete", app.DeleteCacheFileHandler)
 
-	r.HandleFunc("/resource/file/{id}/delete", controllers.DeleteFileHandler)
+	r.HandleFunc("/capture/stream", app.StreamHandler)
 
-	r.HandleFunc("/resource/cache/{project}/upload", controllers.UploadCacheHandler)
+	r.HandleFunc("/capture/focus", app.FocusHandler)
 
-	r.HandleFunc("/resource/cache/{project}/file/{file}/delete", controllers.DeleteCacheFileHandler)
+	r.HandleFunc("/capture/histogram", app.HistogramHandler)
 
-	r.HandleFunc("/capture/stream", controllers.StreamHandler)
+	r.HandleFunc("/capture/state", app.StateHandler)
 
-	r.HandleFunc("/capture/scan", controllers.CaptureScanHandler)
+	r.HandleFunc("/capture/scan", app.CaptureScanHandler)
 
-	fmt.Println("Server is running on port 8080")
-	http.ListenAndServe(":8080", r)
+	fmt.Println("Server is running on", conf.Server.Addr)
+	http.ListenAndServe(conf.Server.Addr, r)
 }
@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"github.com/dstuessy/film-scanner/internal/cache"
+	"github.com/dstuessy/film-scanner/internal/config"
+	"github.com/dstuessy/film-scanner/internal/scan"
+	"github.com/dstuessy/film-scanner/internal/settings"
+	"golang.org/x/oauth2"
+)
+
+// App holds what the handlers share, set up from the configuration at
+// startup.
+type App struct {
+	oauth    *oauth2.Config
+	cache    *cache.Cache
+	settings *settings.Store
+	scanner  *scan.Scanner
+	camera   config.CameraConfig
+}
+
+func NewApp(oauth *oauth2.Config, c *cache.Cache, store *settings.Store, scanner *scan.Scanner, conf config.CameraConfig) *App {
+	return &App{
+		oauth:    oauth,
+		cache:    c,
+		settings: store,
+		scanner:  scanner,
+		camera:   conf,
+	}
+}
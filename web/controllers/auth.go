@@ -12,11 +12,11 @@ import (
 	"github.com/dstuessy/film-scanner/internal/render"
 )
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Url string
 	}{
-		Url: auth.OauthConf.AuthCodeURL("state"),
+		Url: app.oauth.AuthCodeURL("state"),
 	}
 
 	err := render.RenderPage(w, "/login.html", data)
@@ -26,8 +26,8 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func AuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	tok, err := auth.OauthConf.Exchange(
+func (app *App) AuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	tok, err := app.oauth.Exchange(
 		context.Background(), r.URL.Query().Get("code"))
 	if err != nil {
 		log.Println(err)
@@ -1,52 +1,138 @@
 package controllers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dstuessy/film-scanner/internal/auth"
-	"github.com/dstuessy/film-scanner/internal/cache"
 	"github.com/dstuessy/film-scanner/internal/camera"
+	"github.com/dstuessy/film-scanner/internal/negative"
 )
 
 const boundaryWord = "MJPEGBOUNDARY"
 
-func StreamHandler(w http.ResponseWriter, r *http.Request) {
+const eventInterval = 250 * time.Millisecond
+
+const maxLoupeScale = 4
+
+const cropOverlayInterval = time.Second
+
+func (app *App) StreamHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := auth.CheckToken(w, r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	filmType, err := negative.ParseFilmType(r.URL.Query().Get("invert"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// the meters of each page are kept apart by its viewer id
+	viewer := r.URL.Query().Get("viewer")
+	neutralise := r.URL.Query().Get("neutralise") == "true"
+	peaking := r.URL.Query().Get("focus") == "true"
+	withHistogram := r.URL.Query().Get("histogram") == "true"
+
+	loupe, loupeScale, err := parseLoupe(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	overlay, err := parseCropOverlay(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the overlay is detected on the whole preview, so it is hidden in the loupe
+	if !loupe.Empty() {
+		overlay = nil
+	}
+
+	frames := camera.Subscribe()
+	defer camera.Unsubscribe(frames)
+
+	// the loupe is checked against the first frame, before the stream starts
+	var img camera.ImageData
+	select {
+	case <-r.Context().Done():
+		return
+	case img = <-frames:
+	}
+
+	if err := validateLoupe(img, loupe, loupeScale); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", boundaryWord))
 	w.Header().Set("Cache-Control", "no-cache")
 
+	// once the stream has started, errors end it rather than send a response
+stream:
 	for {
-		time.Sleep(camera.FrameInterval)
-
-		img := <-camera.GetStream()
-
-		if len(img.Data) == 0 {
-			log.Println("Stream Empty")
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
+		if err := validateLoupe(img, loupe, loupeScale); err != nil {
+			log.Println("Frame size changed:", err)
+			break stream
 		}
 
-		smallImg, err := camera.ResizeData(img, 0.5)
+		var smallImg camera.ImageData
+		if loupe.Empty() {
+			smallImg, err = camera.ResizeData(img, 0.5)
+		} else {
+			smallImg, err = loupeFrame(img, loupe, loupeScale)
+		}
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
+			break stream
+		}
+
+		if withHistogram {
+			camera.AnalyseHistogram(viewer, smallImg)
+		}
+
+		if overlay != nil {
+			overlay.update(smallImg)
+		}
+
+		smallImg = negative.Preview(smallImg, filmType, neutralise)
+
+		if peaking {
+			smallImg, _, err = camera.AnalyseFocus(viewer, smallImg, true)
+			if err != nil {
+				log.Println(err)
+				break stream
+			}
+		}
+
+		if overlay != nil {
+			smallImg, err = overlay.draw(smallImg)
+			if err != nil {
+				log.Println(err)
+				break stream
+			}
 		}
 
 		jpeg, err := camera.EncodeJpeg(smallImg)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
+			break stream
 		}
 
 		header := strings.Join([]string{
@@ -64,7 +150,13 @@ func StreamHandler(w http.ResponseWriter, r *http.Request) {
 
 		if _, err := w.Write(frame); err != nil {
 			log.Println(err)
-			break
+			break stream
+		}
+
+		select {
+		case <-r.Context().Done():
+			break stream
+		case img = <-frames:
 		}
 	}
 
@@ -72,7 +164,246 @@ func StreamHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func CaptureScanHandler(w http.ResponseWriter, r *http.Request) {
+// parseLoupe reads the loupe region, given as "x,y,w,h" in full resolution
+// pixels, and its scale from the stream parameters. An empty region means
+// the loupe is off.
+func parseLoupe(r *http.Request) (image.Rectangle, float64, error) {
+	param := r.URL.Query().Get("loupe")
+	if param == "" {
+		return image.Rectangle{}, 0, nil
+	}
+
+	parts := strings.Split(param, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, 0, errors.New("Loupe must be given as x,y,w,h")
+	}
+
+	values := make([]int, 4)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Rectangle{}, 0, errors.New(fmt.Sprintf("Invalid loupe value %s", part))
+		}
+		values[i] = v
+	}
+
+	if values[0] < 0 || values[1] < 0 || values[2] <= 0 || values[3] <= 0 {
+		return image.Rectangle{}, 0, errors.New("Loupe region must have a positive size and origin")
+	}
+
+	scale := 1.0
+	if param := r.URL.Query().Get("scale"); param != "" {
+		s, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return image.Rectangle{}, 0, errors.New(fmt.Sprintf("Invalid loupe scale %s", param))
+		}
+		scale = s
+	}
+
+	if scale < 1 || scale > maxLoupeScale {
+		return image.Rectangle{}, 0, errors.New(fmt.Sprintf("Loupe scale must be between 1 and %d", maxLoupeScale))
+	}
+
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), scale, nil
+}
+
+// validateLoupe refuses loupe regions outside the frame and outputs larger
+// than the frame itself.
+func validateLoupe(img camera.ImageData, loupe image.Rectangle, scale float64) error {
+	if loupe.Empty() {
+		return nil
+	}
+
+	if !loupe.In(image.Rect(0, 0, img.Cols, img.Rows)) {
+		return errors.New(fmt.Sprintf("Loupe region is outside of the %dx%d frame", img.Cols, img.Rows))
+	}
+
+	outWidth := float64(loupe.Dx()) * scale
+	outHeight := float64(loupe.Dy()) * scale
+	if outWidth*outHeight > float64(img.Cols*img.Rows) {
+		return errors.New("Loupe output is larger than the frame")
+	}
+
+	return nil
+}
+
+// loupeFrame crops the loupe region out of a full resolution frame and
+// enlarges it.
+func loupeFrame(img camera.ImageData, loupe image.Rectangle, scale float64) (camera.ImageData, error) {
+	region, err := camera.RegionData(img, loupe)
+	if err != nil {
+		return camera.ImageData{}, err
+	}
+
+	if scale == 1 {
+		return region, nil
+	}
+
+	return camera.ResizeData(region, scale)
+}
+
+// cropOverlay runs auto crop detection on preview frames in the background,
+// at most once every cropOverlayInterval, and draws the latest result onto
+// the stream so the film holder and crop ratios can be adjusted live.
+type cropOverlay struct {
+	minCropRatio float64
+	maxCropRatio float64
+
+	mu        sync.Mutex
+	detection camera.CropDetection
+	detecting bool
+	lastRun   time.Time
+}
+
+// parseCropOverlay reads the crop overlay stream parameters. It returns nil
+// if the overlay is off.
+func parseCropOverlay(r *http.Request) (*cropOverlay, error) {
+	if r.URL.Query().Get("cropOverlay") != "true" {
+		return nil, nil
+	}
+
+	o := &cropOverlay{}
+
+	ratios := map[string]*float64{
+		"minCrop": &o.minCropRatio,
+		"maxCrop": &o.maxCropRatio,
+	}
+	for key, field := range ratios {
+		v, err := strconv.ParseFloat(r.URL.Query().Get(key), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s", key))
+		}
+		*field = v
+	}
+
+	if o.minCropRatio <= 0 || o.maxCropRatio > 1 || o.minCropRatio > o.maxCropRatio {
+		return nil, errors.New("Crop ratios must satisfy 0 < minCrop <= maxCrop <= 1")
+	}
+
+	return o, nil
+}
+
+func (o *cropOverlay) update(img camera.ImageData) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.detecting || time.Since(o.lastRun) < cropOverlayInterval {
+		return
+	}
+
+	o.detecting = true
+	o.lastRun = time.Now()
+
+	go func() {
+		d, err := camera.DetectCropData(img, o.minCropRatio, o.maxCropRatio)
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		o.detecting = false
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		o.detection = d
+	}()
+}
+
+func (o *cropOverlay) draw(img camera.ImageData) (camera.ImageData, error) {
+	o.mu.Lock()
+	d := o.detection
+	o.mu.Unlock()
+
+	return camera.DrawCropDetection(img, d)
+}
+
+// FocusHandler sends the sharpness of the preview as server-sent events
+// while a stream with focus peaking is open.
+func (app *App) FocusHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.CheckToken(w, r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	viewer := r.URL.Query().Get("viewer")
+	camera.ResetFocusPeak(viewer)
+
+	sendEvents(w, r, func() interface{} {
+		return camera.GetFocus(viewer)
+	})
+
+	log.Println("Focus events disconnected")
+}
+
+// HistogramHandler sends the histogram of the preview as server-sent
+// events while a stream with the histogram enabled is open.
+func (app *App) HistogramHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.CheckToken(w, r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	viewer := r.URL.Query().Get("viewer")
+
+	sendEvents(w, r, func() interface{} {
+		return camera.GetHistogram(viewer)
+	})
+
+	log.Println("Histogram events disconnected")
+}
+
+// StateHandler sends the status of the camera as server-sent events, so the
+// scan page can show when the preview is paused for a capture.
+func (app *App) StateHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.CheckToken(w, r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	sendEvents(w, r, func() interface{} {
+		return camera.GetStatus()
+	})
+
+	log.Println("State events disconnected")
+}
+
+// sendEvents writes the JSON encoded result of event as a server-sent event
+// every eventInterval until the client disconnects.
+func sendEvents(w http.ResponseWriter, r *http.Request, event func() interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming not supported by response writer")
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(eventInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			data, err := json.Marshal(event())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				log.Println(err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (app *App) CaptureScanHandler(w http.ResponseWriter, r *http.Request) {
 	if _, err := auth.CheckToken(w, r); err != nil {
 		log.Println(err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -86,39 +417,28 @@ func CaptureScanHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("Closing Camera")
-
-	if err := camera.CloseCamera(); err != nil {
+	projectSettings, err := app.settings.Read(projectId[0])
+	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
-	defer func() {
-		if camera.IsCameraOpen() {
-			return
-		}
 
-		log.Println("Re-Opening Camera")
-
-		if err := camera.OpenCamera(); err != nil {
-			log.Println(err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-		}
-	}()
-
-	time.Sleep(500 * time.Millisecond)
-
-	img, err := camera.CaptureStill()
+	err = app.scanner.Capture(projectId[0], projectSettings, fmt.Sprintf("image-%d", time.Now().Unix()))
+	if errors.Is(err, camera.ErrBusy) {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 
-	name := camera.BuildFileName(fmt.Sprintf("image-%d", time.Now().Unix()))
-	if err := cache.CacheImage(img, name, projectId[0]); err != nil {
+	projectSettings.NextFrame++
+	if err := app.settings.Save(projectId[0], projectSettings); err != nil {
 		log.Println(err)
-		http.Error(w, "Internal Error", http.StatusInternalServerError)
 	}
 
 	return
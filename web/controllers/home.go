@@ -10,14 +10,14 @@ import (
 	gdrive "google.golang.org/api/drive/v3"
 )
 
-func HomeHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	srv, err := drive.GetDriveFileService(token, drive.GetContext())
+	srv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
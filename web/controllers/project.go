@@ -6,9 +6,10 @@ import (
 	"net/http"
 
 	"github.com/dstuessy/film-scanner/internal/auth"
-	"github.com/dstuessy/film-scanner/internal/cache"
 	"github.com/dstuessy/film-scanner/internal/drive"
 	"github.com/dstuessy/film-scanner/internal/render"
+	"github.com/dstuessy/film-scanner/internal/scan"
+	"github.com/dstuessy/film-scanner/internal/settings"
 	"github.com/gorilla/mux"
 	gdrive "google.golang.org/api/drive/v3"
 )
@@ -18,14 +19,14 @@ type Breadcrumb struct {
 	Link string
 }
 
-func ProjectHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) ProjectHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	srv, err := drive.GetDriveFileService(token, drive.GetContext())
+	srv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -61,7 +62,14 @@ func ProjectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cacheFiles, err := cache.ReadProject(projectId)
+	cacheFiles, err := app.scanner.ReadCache(projectId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	projectSettings, err := app.settings.Read(projectId)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -72,7 +80,8 @@ func ProjectHandler(w http.ResponseWriter, r *http.Request) {
 		Directory     *gdrive.File
 		Breadcrumbs   []Breadcrumb
 		NextPageToken string
-		Cache         []string
+		Cache         []scan.CachedScan
+		Settings      settings.Settings
 		Files         []*gdrive.File
 	}{
 		Directory: dir,
@@ -82,6 +91,7 @@ func ProjectHandler(w http.ResponseWriter, r *http.Request) {
 		},
 		NextPageToken: files.NextPageToken,
 		Cache:         cacheFiles,
+		Settings:      projectSettings,
 		Files:         files.Files,
 	}
 
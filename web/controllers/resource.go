@@ -4,23 +4,26 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/dstuessy/film-scanner/internal/auth"
-	"github.com/dstuessy/film-scanner/internal/cache"
+	"github.com/dstuessy/film-scanner/internal/camera"
 	"github.com/dstuessy/film-scanner/internal/drive"
+	"github.com/dstuessy/film-scanner/internal/negative"
 	"github.com/dstuessy/film-scanner/internal/render"
 	"github.com/gorilla/mux"
 	gdrive "google.golang.org/api/drive/v3"
 )
 
-func NewWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) NewWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	fileSrv, err := drive.GetDriveFileService(token, drive.GetContext())
+	fileSrv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -35,14 +38,14 @@ func NewWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func NewProjectHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) NewProjectHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	fileSrv, err := drive.GetDriveFileService(token, drive.GetContext())
+	fileSrv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -65,14 +68,14 @@ func NewProjectHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("HX-Redirect", fmt.Sprintf("/project/%s", folder.Id))
 }
 
-func GetProjectHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) GetProjectHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	fileSrv, err := drive.GetDriveFileService(token, drive.GetContext())
+	fileSrv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -124,7 +127,118 @@ func GetProjectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) SaveProjectSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := auth.CheckToken(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	projectId, ok := mux.Vars(r)["id"]
+	if !ok {
+		log.Println(fmt.Sprintf("Project id not found in URL: %s", r.URL.Path))
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	s, err := app.settings.Read(projectId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	r.ParseForm()
+
+	s.AutoCrop = r.Form.Get("autoCrop") == "on"
+	s.Deskew = r.Form.Get("deskew") == "on"
+	s.Exposure = strings.TrimSpace(r.Form.Get("exposure"))
+	s.ISO = strings.TrimSpace(r.Form.Get("iso"))
+	s.Brackets = strings.TrimSpace(r.Form.Get("brackets"))
+	s.KeepBrackets = r.Form.Get("keepBrackets") == "on"
+	s.BracketPages = r.Form.Get("bracketPages") == "on"
+	s.Compression = r.Form.Get("compression")
+	s.Thumbnail = r.Form.Get("thumbnail") == "on"
+	s.ColourProfile = r.Form.Get("colourProfile")
+	s.OutputFormat = r.Form.Get("outputFormat")
+	s.JpegSubsampling = r.Form.Get("jpegSubsampling")
+	s.FilmStock = strings.TrimSpace(r.Form.Get("filmStock"))
+	s.Roll = strings.TrimSpace(r.Form.Get("roll"))
+	s.DevelopmentNotes = strings.TrimSpace(r.Form.Get("developmentNotes"))
+	s.Artist = strings.TrimSpace(r.Form.Get("artist"))
+	s.Copyright = strings.TrimSpace(r.Form.Get("copyright"))
+
+	nextFrame, err := strconv.Atoi(r.Form.Get("nextFrame"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid value for nextFrame", http.StatusBadRequest)
+		return
+	}
+	s.NextFrame = nextFrame
+
+	shots, err := strconv.Atoi(r.Form.Get("shots"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid value for shots", http.StatusBadRequest)
+		return
+	}
+	s.Shots = shots
+
+	jpegQuality, err := strconv.Atoi(r.Form.Get("jpegQuality"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Invalid value for jpegQuality", http.StatusBadRequest)
+		return
+	}
+	s.JpegQuality = jpegQuality
+	s.KeepOriginal = r.Form.Get("keepOriginal") == "on"
+
+	filmType, err := negative.ParseFilmType(r.Form.Get("filmType"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.FilmType = filmType
+
+	floats := map[string]*float64{
+		"minCropRatio": &s.MinCropRatio,
+		"maxCropRatio": &s.MaxCropRatio,
+		"trimX":        &s.TrimX,
+		"trimY":        &s.TrimY,
+		"baseX":        &s.BaseX,
+		"baseY":        &s.BaseY,
+		"baseWidth":    &s.BaseWidth,
+		"baseHeight":   &s.BaseHeight,
+		"dpi":          &s.DPI,
+	}
+	for key, field := range floats {
+		v, err := strconv.ParseFloat(r.Form.Get(key), 64)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprintf("Invalid value for %s", key), http.StatusBadRequest)
+			return
+		}
+		*field = v
+	}
+
+	if err := s.Validate(); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.settings.Save(projectId, s); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+	return
+}
+
+func (app *App) DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -138,7 +252,7 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileSrv, err := drive.GetDriveFileService(token, drive.GetContext())
+	fileSrv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -150,7 +264,7 @@ func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DeleteCacheFileHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) DeleteCacheFileHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -171,7 +285,7 @@ func DeleteCacheFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cache.DeleteImage(projectId, fileName) != nil {
+	if app.cache.DeleteImage(projectId, fileName) != nil {
 		log.Println(err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
@@ -181,7 +295,7 @@ func DeleteCacheFileHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func UploadCacheHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) UploadCacheHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -195,14 +309,14 @@ func UploadCacheHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := cache.ReadProject(projectId)
+	files, err := app.cache.ReadProject(projectId)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 
-	srv, err := drive.GetDriveFileService(token, drive.GetContext())
+	srv, err := drive.GetDriveFileService(app.oauth, token, drive.GetContext())
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -210,20 +324,22 @@ func UploadCacheHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, file := range files {
-		jpeg, err := cache.ReadImage(projectId, file)
+		img, err := app.cache.OpenImage(projectId, file)
 		if err != nil {
 			log.Println(err)
 			http.Error(w, "Internal Error", http.StatusInternalServerError)
 			return
 		}
 
-		if _, err := drive.SaveImage(srv, jpeg, file, projectId); err != nil {
+		_, err = drive.SaveImage(srv, img, file, camera.MimeType(app.camera, file), projectId)
+		img.Close()
+		if err != nil {
 			log.Println(err)
 			http.Error(w, "Internal Error", http.StatusInternalServerError)
 			return
 		}
 
-		if cache.DeleteImage(projectId, file) != nil {
+		if app.cache.DeleteImage(projectId, file) != nil {
 			log.Println(err)
 			http.Error(w, "Internal Error", http.StatusInternalServerError)
 			return
@@ -7,10 +7,11 @@ import (
 
 	"github.com/dstuessy/film-scanner/internal/auth"
 	"github.com/dstuessy/film-scanner/internal/render"
+	"github.com/dstuessy/film-scanner/internal/settings"
 	"github.com/gorilla/mux"
 )
 
-func NewScanHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) NewScanHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := auth.CheckToken(w, r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -24,10 +25,19 @@ func NewScanHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	projectSettings, err := app.settings.Read(projectId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
 	data := struct {
 		ProjectId string
+		Settings  settings.Settings
 	}{
 		ProjectId: projectId,
+		Settings:  projectSettings,
 	}
 
 	if err := render.RenderPage(w, "/new.html", data); err != nil {